@@ -0,0 +1,183 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gdl90.go: GDL90 framing - CRC, byte stuffing, and splitting a byte stream into frames.
+	 See "GDL 90 Data Interface Specification", 560-1058-00 Rev A.
+*/
+
+package gdl90
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	FLAG_BYTE    = 0x7E
+	CONTROL_ESC  = 0x7D
+	ESCAPE_XOR   = 0x20
+	MIN_FRAME_SZ = 5 // Flag, message ID, two CRC bytes, flag.
+)
+
+var crc16Table [256]uint16
+
+var (
+	ErrNoFlags      = errors.New("gdl90: frame not delimited by flag bytes")
+	ErrShortFrame   = errors.New("gdl90: frame too short")
+	ErrBadEscape    = errors.New("gdl90: invalid control-escape sequence")
+	ErrEmbeddedFlag = errors.New("gdl90: flag byte inside frame")
+	ErrShortMessage = errors.New("gdl90: message too short")
+)
+
+// Construct the CRC table. Adapted from GDL90 spec, p.7.
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for bitctr := 0; bitctr < 8; bitctr++ {
+			z := uint16(0)
+			if (crc & 0x8000) != 0 {
+				z = 0x1021
+			}
+			crc = (crc << 1) ^ z
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// CRC computes the GDL90 frame check sequence (CRC-CCITT) of a message.
+func CRC(data []byte) uint16 {
+	ret := uint16(0)
+	for i := 0; i < len(data); i++ {
+		ret = crc16Table[ret>>8] ^ (ret << 8) ^ uint16(data[i])
+	}
+	return ret
+}
+
+// Frame adds the CRC to a message (message ID and data), escapes flag and control-escape bytes,
+// and adds the start and end flags.
+func Frame(msg []byte) []byte {
+	crc := CRC(msg)
+	body := make([]byte, 0, len(msg)+2)
+	body = append(body, msg...)
+	body = append(body, byte(crc&0xFF), byte(crc>>8))
+
+	ret := make([]byte, 0, len(body)+8)
+	ret = append(ret, FLAG_BYTE)
+	for _, b := range body {
+		if b == FLAG_BYTE || b == CONTROL_ESC {
+			ret = append(ret, CONTROL_ESC)
+			b ^= ESCAPE_XOR
+		}
+		ret = append(ret, b)
+	}
+	ret = append(ret, FLAG_BYTE)
+	return ret
+}
+
+// Unframe removes the flags and byte stuffing from a frame and checks the CRC. Returns the message
+// (message ID and data) without the CRC.
+func Unframe(frame []byte) ([]byte, error) {
+	if len(frame) < MIN_FRAME_SZ {
+		return nil, ErrShortFrame
+	}
+	if frame[0] != FLAG_BYTE || frame[len(frame)-1] != FLAG_BYTE {
+		return nil, ErrNoFlags
+	}
+	msg := make([]byte, 0, len(frame))
+	for i := 1; i < len(frame)-1; i++ {
+		b := frame[i]
+		switch b {
+		case FLAG_BYTE:
+			return nil, ErrEmbeddedFlag
+		case CONTROL_ESC:
+			i++
+			if i >= len(frame)-1 || (frame[i] != FLAG_BYTE^ESCAPE_XOR && frame[i] != CONTROL_ESC^ESCAPE_XOR) {
+				return nil, ErrBadEscape
+			}
+			b = frame[i] ^ ESCAPE_XOR
+		}
+		msg = append(msg, b)
+	}
+	if len(msg) < 3 {
+		return nil, ErrShortFrame
+	}
+	n := len(msg) - 2
+	crc := uint16(msg[n]) | uint16(msg[n+1])<<8
+	if c := CRC(msg[:n]); c != crc {
+		return nil, fmt.Errorf("gdl90: CRC mismatch, computed %04X, received %04X", c, crc)
+	}
+	return msg[:n], nil
+}
+
+// ScanFrames is a bufio.SplitFunc that splits a GDL90 byte stream into frames, including their
+// flag bytes. Data before the first flag byte and empty frames are skipped. Frames may share a
+// flag byte, as some devices send them back-to-back with one flag in between.
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.IndexByte(data, FLAG_BYTE)
+	if start < 0 {
+		return len(data), nil, nil // Nothing useful yet.
+	}
+	for {
+		end := bytes.IndexByte(data[start+1:], FLAG_BYTE)
+		if end < 0 {
+			if atEOF {
+				return len(data), nil, nil // Incomplete frame at end of stream.
+			}
+			return start, nil, nil // Need more data.
+		}
+		end += start + 1
+		if end == start+1 {
+			start = end // Empty frame - the second flag starts the next frame.
+			continue
+		}
+		// Leave the closing flag in the buffer, in case it is also the opening flag of the next frame.
+		return end, data[start : end+1], nil
+	}
+}
+
+// LON_LAT_RESOLUTION is the resolution of latitude and longitude in 24-bit GDL90 fields, degrees.
+const LON_LAT_RESOLUTION = float32(180.0 / 8388608.0)
+
+// TRACK_RESOLUTION is the resolution of the 8-bit track/heading field, degrees.
+const TRACK_RESOLUTION = float32(360.0 / 256.0)
+
+// EncodeLatLng encodes latitude or longitude as a 24-bit signed binary fraction, MSB first.
+func EncodeLatLng(v float32) []byte {
+	ret := make([]byte, 3)
+
+	v = v / LON_LAT_RESOLUTION
+	wk := int32(v)
+
+	ret[0] = byte((wk & 0xFF0000) >> 16)
+	ret[1] = byte((wk & 0x00FF00) >> 8)
+	ret[2] = byte((wk & 0x0000FF))
+
+	return ret
+}
+
+// DecodeLatLng decodes a 24-bit signed latitude or longitude.
+func DecodeLatLng(b []byte) float32 {
+	wk := int32(b[0])<<16 | int32(b[1])<<8 | int32(b[2])
+	if wk&0x800000 != 0 {
+		wk -= 0x1000000 // Sign extend.
+	}
+	return float32(wk) * LON_LAT_RESOLUTION
+}
+
+// EncodeTrack encodes a track or heading, degrees, rounded to the nearest 8-bit value.
+func EncodeTrack(trk float32) byte {
+	v := int((trk/TRACK_RESOLUTION)+0.5) % 256
+	if v < 0 {
+		v += 256
+	}
+	return byte(v)
+}
+
+// DecodeTrack decodes an 8-bit track or heading, degrees.
+func DecodeTrack(b byte) float32 {
+	return float32(b) * TRACK_RESOLUTION
+}
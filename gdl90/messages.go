@@ -0,0 +1,421 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	messages.go: Typed GDL90 messages, encoding and decoding.
+*/
+
+package gdl90
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message IDs. See GDL90 spec, p.4.
+const (
+	MSGTYPE_HEARTBEAT             = 0x00
+	MSGTYPE_INITIALIZATION        = 0x02
+	MSGTYPE_UPLINK                = 0x07
+	MSGTYPE_HEIGHT_ABOVE_TERRAIN  = 0x09
+	MSGTYPE_OWNSHIP_REPORT        = 0x0A
+	MSGTYPE_OWNSHIP_GEOMETRIC_ALT = 0x0B
+	MSGTYPE_TRAFFIC_REPORT        = 0x14
+	MSGTYPE_BASIC_REPORT          = 0x1E
+	MSGTYPE_LONG_REPORT           = 0x1F
+)
+
+// Lengths of standard messages, including the message ID.
+var messageLengths = map[byte]int{
+	MSGTYPE_HEARTBEAT:             7,
+	MSGTYPE_INITIALIZATION:        3,
+	MSGTYPE_UPLINK:                436,
+	MSGTYPE_HEIGHT_ABOVE_TERRAIN:  3,
+	MSGTYPE_OWNSHIP_REPORT:        28,
+	MSGTYPE_OWNSHIP_GEOMETRIC_ALT: 5,
+	MSGTYPE_TRAFFIC_REPORT:        28,
+	MSGTYPE_BASIC_REPORT:          22,
+	MSGTYPE_LONG_REPORT:           38,
+}
+
+const (
+	UPLINK_PAYLOAD_LENGTH = 432
+	BASIC_REPORT_LENGTH   = 18
+	LONG_REPORT_LENGTH    = 34
+	TIME_OF_RECEPTION_NA  = 0xFFFFFF // Time of reception is not valid.
+	VFOM_NOT_AVAILABLE    = 0x7FFF
+)
+
+// Traffic report "tt" field types. See GDL90 spec, p.24.
+const (
+	TRACK_TYPE_INVALID    = 0
+	TRACK_TYPE_TRUE_TRACK = 1
+	TRACK_TYPE_MAG_HDG    = 2
+	TRACK_TYPE_TRUE_HDG   = 3
+)
+
+// Message is a decoded GDL90 message.
+type Message interface {
+	ID() byte
+	Marshal() []byte // Message ID and data, without CRC or framing.
+}
+
+// Encode frames a message for sending.
+func Encode(m Message) []byte {
+	return Frame(m.Marshal())
+}
+
+// Decode unframes a frame, checks its CRC, and decodes the message in it.
+func Decode(frame []byte) (Message, error) {
+	msg, err := Unframe(frame)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(msg)
+}
+
+// Parse decodes an unframed message (message ID and data). Messages that aren't decoded by this
+// package, e.g. vendor extensions, are returned as Raw.
+func Parse(msg []byte) (Message, error) {
+	if len(msg) < 1 {
+		return nil, ErrShortMessage
+	}
+	if l, ok := messageLengths[msg[0]]; ok && len(msg) != l {
+		return nil, fmt.Errorf("gdl90: message type 0x%02X is %d bytes, expected %d", msg[0], len(msg), l)
+	}
+	switch msg[0] {
+	case MSGTYPE_HEARTBEAT:
+		return parseHeartbeat(msg), nil
+	case MSGTYPE_UPLINK:
+		return UplinkData{TimeOfReception: parseTimeOfReception(msg[1:4]), Payload: copyBytes(msg[4:])}, nil
+	case MSGTYPE_OWNSHIP_REPORT:
+		return OwnshipReport{parseTrafficReport(msg)}, nil
+	case MSGTYPE_OWNSHIP_GEOMETRIC_ALT:
+		return parseOwnshipGeometricAltitude(msg), nil
+	case MSGTYPE_TRAFFIC_REPORT:
+		return parseTrafficReport(msg), nil
+	case MSGTYPE_BASIC_REPORT, MSGTYPE_LONG_REPORT:
+		return PassThroughReport{Long: msg[0] == MSGTYPE_LONG_REPORT, TimeOfReception: parseTimeOfReception(msg[1:4]), Payload: copyBytes(msg[4:])}, nil
+	}
+	return Raw{Type: msg[0], Data: copyBytes(msg[1:])}, nil
+}
+
+func copyBytes(b []byte) []byte {
+	ret := make([]byte, len(b))
+	copy(ret, b)
+	return ret
+}
+
+// Raw is a message that isn't decoded by this package.
+type Raw struct {
+	Type byte
+	Data []byte // Message data, after the message ID.
+}
+
+func (m Raw) ID() byte {
+	return m.Type
+}
+
+func (m Raw) Marshal() []byte {
+	return append([]byte{m.Type}, m.Data...)
+}
+
+// Heartbeat message. See GDL90 spec, p.10.
+type Heartbeat struct {
+	GPSPositionValid    bool
+	MaintenanceRequired bool
+	Ident               bool
+	AddrTalkback        bool
+	GPSBatteryLow       bool
+	RATCS               bool
+	UATInitialized      bool
+	CSARequested        bool
+	CSANotAvailable     bool
+	UTCOK               bool
+	Timestamp           uint32 // Seconds since 0000Z. 17 bits.
+	UplinkCount         uint8  // Uplink messages received in the previous second. 5 bits.
+	BasicLongCount      uint16 // Basic and long messages received in the previous second. 10 bits.
+}
+
+func (m Heartbeat) ID() byte {
+	return MSGTYPE_HEARTBEAT
+}
+
+func setBit(b *byte, mask byte, v bool) {
+	if v {
+		*b |= mask
+	}
+}
+
+func (m Heartbeat) Marshal() []byte {
+	msg := make([]byte, 7)
+	msg[0] = MSGTYPE_HEARTBEAT
+	setBit(&msg[1], 0x80, m.GPSPositionValid)
+	setBit(&msg[1], 0x40, m.MaintenanceRequired)
+	setBit(&msg[1], 0x20, m.Ident)
+	setBit(&msg[1], 0x10, m.AddrTalkback)
+	setBit(&msg[1], 0x08, m.GPSBatteryLow)
+	setBit(&msg[1], 0x04, m.RATCS)
+	setBit(&msg[1], 0x01, m.UATInitialized)
+
+	msg[2] = byte((m.Timestamp>>16)&0x01) << 7
+	setBit(&msg[2], 0x40, m.CSARequested)
+	setBit(&msg[2], 0x20, m.CSANotAvailable)
+	setBit(&msg[2], 0x01, m.UTCOK)
+	msg[3] = byte(m.Timestamp & 0xFF)
+	msg[4] = byte((m.Timestamp & 0xFFFF) >> 8)
+
+	msg[5] = byte((m.UplinkCount&0x1F)<<3) | byte((m.BasicLongCount>>8)&0x03)
+	msg[6] = byte(m.BasicLongCount & 0xFF)
+	return msg
+}
+
+func parseHeartbeat(msg []byte) Heartbeat {
+	return Heartbeat{
+		GPSPositionValid:    msg[1]&0x80 != 0,
+		MaintenanceRequired: msg[1]&0x40 != 0,
+		Ident:               msg[1]&0x20 != 0,
+		AddrTalkback:        msg[1]&0x10 != 0,
+		GPSBatteryLow:       msg[1]&0x08 != 0,
+		RATCS:               msg[1]&0x04 != 0,
+		UATInitialized:      msg[1]&0x01 != 0,
+		CSARequested:        msg[2]&0x40 != 0,
+		CSANotAvailable:     msg[2]&0x20 != 0,
+		UTCOK:               msg[2]&0x01 != 0,
+		Timestamp:           uint32(msg[2]>>7)<<16 | uint32(msg[4])<<8 | uint32(msg[3]),
+		UplinkCount:         msg[5] >> 3,
+		BasicLongCount:      uint16(msg[5]&0x03)<<8 | uint16(msg[6]),
+	}
+}
+
+// Time of reception is in 80 ns units since the start of the UTC second, LSB first.
+func putTimeOfReception(b []byte, tor uint32) {
+	b[0] = byte(tor & 0xFF)
+	b[1] = byte((tor >> 8) & 0xFF)
+	b[2] = byte((tor >> 16) & 0xFF)
+}
+
+func parseTimeOfReception(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// UplinkData message - a UAT uplink (ground station) payload. See GDL90 spec, p.15.
+type UplinkData struct {
+	TimeOfReception uint32 // 80 ns units. TIME_OF_RECEPTION_NA if not valid.
+	Payload         []byte // UPLINK_PAYLOAD_LENGTH bytes.
+}
+
+func (m UplinkData) ID() byte {
+	return MSGTYPE_UPLINK
+}
+
+func (m UplinkData) Marshal() []byte {
+	msg := make([]byte, 4, 4+len(m.Payload))
+	msg[0] = MSGTYPE_UPLINK
+	putTimeOfReception(msg[1:4], m.TimeOfReception)
+	return append(msg, m.Payload...)
+}
+
+// PassThroughReport message - a UAT basic or long ADS-B report. See GDL90 spec, p.31.
+type PassThroughReport struct {
+	Long            bool   // Long report (MSGTYPE_LONG_REPORT), otherwise basic report.
+	TimeOfReception uint32 // 80 ns units. TIME_OF_RECEPTION_NA if not valid.
+	Payload         []byte // BASIC_REPORT_LENGTH or LONG_REPORT_LENGTH bytes.
+}
+
+func (m PassThroughReport) ID() byte {
+	if m.Long {
+		return MSGTYPE_LONG_REPORT
+	}
+	return MSGTYPE_BASIC_REPORT
+}
+
+func (m PassThroughReport) Marshal() []byte {
+	msg := make([]byte, 4, 4+len(m.Payload))
+	msg[0] = m.ID()
+	putTimeOfReception(msg[1:4], m.TimeOfReception)
+	return append(msg, m.Payload...)
+}
+
+// TrafficReport message. See GDL90 spec, p.17.
+type TrafficReport struct {
+	Alert        bool   // Traffic alert status.
+	AddrType     uint8  // Address type. 0 = ADS-B with ICAO address, 1 = ADS-B with self-assigned address, 2 = TIS-B with ICAO address, etc.
+	Address      uint32 // 24 bits.
+	Lat          float32
+	Lng          float32
+	AltValid     bool
+	Alt          int32 // Pressure altitude, feet. 25 ft resolution.
+	TrackType    uint8 // TRACK_TYPE_*
+	Extrapolated bool  // Report is extrapolated, not updated.
+	Airborne     bool
+	NIC          uint8
+	NACp         uint8
+	SpeedValid   bool
+	Speed        uint16 // Horizontal velocity, knots.
+	VvelValid    bool
+	Vvel         int16   // Vertical velocity, feet per minute. 64 fpm resolution.
+	Track        float32 // Track or heading, degrees. See TrackType.
+	Emitter      uint8   // Emitter category.
+	Callsign     string  // Up to 8 characters.
+	Priority     uint8   // Emergency/priority code.
+}
+
+func (m TrafficReport) ID() byte {
+	return MSGTYPE_TRAFFIC_REPORT
+}
+
+func (m TrafficReport) Marshal() []byte {
+	return m.marshal(MSGTYPE_TRAFFIC_REPORT)
+}
+
+func (m TrafficReport) marshal(msgType byte) []byte {
+	msg := make([]byte, 28)
+	msg[0] = msgType
+
+	msg[1] = m.AddrType & 0x0F
+	setBit(&msg[1], 0x10, m.Alert)
+
+	msg[2] = byte((m.Address & 0x00FF0000) >> 16)
+	msg[3] = byte((m.Address & 0x0000FF00) >> 8)
+	msg[4] = byte((m.Address & 0x000000FF))
+
+	copy(msg[5:8], EncodeLatLng(m.Lat))
+	copy(msg[8:11], EncodeLatLng(m.Lng))
+
+	// Altitude: 1,000 foot offset and 25 foot resolution. 0xFFF is invalid or unavailable.
+	alt := uint16(0xFFF)
+	if m.AltValid && m.Alt >= -1000 && m.Alt <= 101350 {
+		alt = uint16((m.Alt + 1000) / 25)
+	}
+	msg[11] = byte((alt & 0xFF0) >> 4)
+	msg[12] = byte((alt & 0x00F) << 4)
+
+	// "m" field. Lower two bits are the "tt" type, then extrapolated and airborne flags.
+	msg[12] |= m.TrackType & 0x03
+	setBit(&msg[12], 0x04, m.Extrapolated)
+	setBit(&msg[12], 0x08, m.Airborne)
+
+	msg[13] = ((m.NIC << 4) & 0xF0) | (m.NACp & 0x0F)
+
+	// Horizontal velocity. 0xFFF is no information, 0xFFE is 4094 knots or more.
+	speed := uint16(0xFFF)
+	if m.SpeedValid {
+		speed = m.Speed
+		if speed > 0xFFE {
+			speed = 0xFFE
+		}
+	}
+	msg[14] = byte((speed & 0x0FF0) >> 4)
+	msg[15] = byte((speed & 0x000F) << 4)
+
+	// Vertical velocity, 12-bit signed. 0x800 is no information, 0x1FE/0xE02 are over 32,576 fpm.
+	vvel := int16(0x800)
+	if m.VvelValid {
+		vvel = m.Vvel / 64
+		if vvel > 0x1FE {
+			vvel = 0x1FE
+		} else if vvel < -0x1FE {
+			vvel = -0x1FE
+		}
+	}
+	msg[15] |= byte((vvel & 0x0F00) >> 8)
+	msg[16] = byte(vvel & 0x00FF)
+
+	msg[17] = EncodeTrack(m.Track)
+	msg[18] = m.Emitter
+
+	// msg[19] to msg[26] are call sign, padded with spaces.
+	for i := 0; i < 8; i++ {
+		c := byte(' ')
+		if i < len(m.Callsign) {
+			c = m.Callsign[i]
+		}
+		msg[19+i] = c
+	}
+
+	msg[27] = (m.Priority & 0x0F) << 4
+	return msg
+}
+
+func parseTrafficReport(msg []byte) TrafficReport {
+	m := TrafficReport{
+		Alert:        msg[1]&0xF0 == 0x10,
+		AddrType:     msg[1] & 0x0F,
+		Address:      uint32(msg[2])<<16 | uint32(msg[3])<<8 | uint32(msg[4]),
+		Lat:          DecodeLatLng(msg[5:8]),
+		Lng:          DecodeLatLng(msg[8:11]),
+		TrackType:    msg[12] & 0x03,
+		Extrapolated: msg[12]&0x04 != 0,
+		Airborne:     msg[12]&0x08 != 0,
+		NIC:          msg[13] >> 4,
+		NACp:         msg[13] & 0x0F,
+		Track:        DecodeTrack(msg[17]),
+		Emitter:      msg[18],
+		Callsign:     strings.TrimRight(string(msg[19:27]), " \x00"),
+		Priority:     msg[27] >> 4,
+	}
+	if alt := uint16(msg[11])<<4 | uint16(msg[12]>>4); alt != 0xFFF {
+		m.AltValid = true
+		m.Alt = int32(alt)*25 - 1000
+	}
+	if speed := uint16(msg[14])<<4 | uint16(msg[15]>>4); speed != 0xFFF {
+		m.SpeedValid = true
+		m.Speed = speed
+	}
+	if vvel := int16(msg[15]&0x0F)<<8 | int16(msg[16]); vvel != 0x800 {
+		if vvel&0x800 != 0 {
+			vvel -= 0x1000 // Sign extend.
+		}
+		m.VvelValid = true
+		m.Vvel = vvel * 64
+	}
+	return m
+}
+
+// OwnshipReport message. Same format as the traffic report. See GDL90 spec, p.16.
+type OwnshipReport struct {
+	TrafficReport
+}
+
+func (m OwnshipReport) ID() byte {
+	return MSGTYPE_OWNSHIP_REPORT
+}
+
+func (m OwnshipReport) Marshal() []byte {
+	return m.marshal(MSGTYPE_OWNSHIP_REPORT)
+}
+
+// OwnshipGeometricAltitude message. See GDL90 spec, p.28.
+type OwnshipGeometricAltitude struct {
+	Alt             int32 // Geometric altitude, feet. 5 ft resolution.
+	VerticalWarning bool
+	VFOM            uint16 // Vertical figure of merit, meters. VFOM_NOT_AVAILABLE if not available.
+}
+
+func (m OwnshipGeometricAltitude) ID() byte {
+	return MSGTYPE_OWNSHIP_GEOMETRIC_ALT
+}
+
+func (m OwnshipGeometricAltitude) Marshal() []byte {
+	msg := make([]byte, 5)
+	msg[0] = MSGTYPE_OWNSHIP_GEOMETRIC_ALT
+	alt := int16(m.Alt / 5)
+	msg[1] = byte(alt >> 8)
+	msg[2] = byte(alt & 0x00FF)
+	vfom := m.VFOM & 0x7FFF
+	msg[3] = byte(vfom >> 8)
+	setBit(&msg[3], 0x80, m.VerticalWarning)
+	msg[4] = byte(vfom & 0xFF)
+	return msg
+}
+
+func parseOwnshipGeometricAltitude(msg []byte) OwnshipGeometricAltitude {
+	return OwnshipGeometricAltitude{
+		Alt:             int32(int16(uint16(msg[1])<<8|uint16(msg[2]))) * 5,
+		VerticalWarning: msg[3]&0x80 != 0,
+		VFOM:            uint16(msg[3]&0x7F)<<8 | uint16(msg[4]),
+	}
+}
@@ -0,0 +1,144 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	messages_test.go: Encode/decode round trips and validation of GDL90 messages.
+*/
+
+package gdl90
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Positions, altitudes and tracks are chosen to be exactly representable in the GDL90 fields, so
+// that they survive the round trip unchanged.
+var roundTripMessages = []struct {
+	name string
+	m    Message
+}{
+	{"heartbeat", Heartbeat{
+		GPSPositionValid: true,
+		UATInitialized:   true,
+		UTCOK:            true,
+		Timestamp:        86399, // Uses the 17th bit.
+		UplinkCount:      31,
+		BasicLongCount:   1023,
+	}},
+	{"traffic", TrafficReport{
+		Alert:      true,
+		AddrType:   2,
+		Address:    0xA1B2C3,
+		Lat:        45,
+		Lng:        -135,
+		AltValid:   true,
+		Alt:        4500,
+		TrackType:  TRACK_TYPE_TRUE_TRACK,
+		Airborne:   true,
+		NIC:        8,
+		NACp:       9,
+		SpeedValid: true,
+		Speed:      120,
+		VvelValid:  true,
+		Vvel:       -640,
+		Track:      90,
+		Emitter:    1,
+		Callsign:   "N12345",
+	}},
+	{"traffic, FAA call sign", TrafficReport{
+		AddrType:  3,
+		Address:   0x7E7D7E, // Needs escaping.
+		Lat:       -45,
+		Lng:       90,
+		TrackType: TRACK_TYPE_INVALID,
+		Callsign:  "uN5142Q",
+	}},
+	{"ownship", OwnshipReport{TrafficReport{
+		Address:    0xF00000,
+		Lat:        22.5,
+		Lng:        -67.5,
+		AltValid:   true,
+		Alt:        -1000,
+		TrackType:  TRACK_TYPE_TRUE_TRACK,
+		Airborne:   true,
+		NIC:        11,
+		NACp:       11,
+		SpeedValid: true,
+		Speed:      4094,
+		Track:      358.59375,
+		Callsign:   "STRATUX",
+	}}},
+	{"uplink", UplinkData{
+		TimeOfReception: TIME_OF_RECEPTION_NA,
+		Payload:         uplinkPayload(),
+	}},
+}
+
+// uplinkPayload returns a payload with every byte value, including flag and control-escape bytes.
+func uplinkPayload() []byte {
+	b := make([]byte, UPLINK_PAYLOAD_LENGTH)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range roundTripMessages {
+		frame := Frame(tc.m.Marshal())
+		if !reflect.DeepEqual(frame, Encode(tc.m)) {
+			t.Errorf("%s: Frame(Marshal()) and Encode() differ", tc.name)
+		}
+
+		msg, err := Unframe(frame)
+		if err != nil {
+			t.Errorf("%s: Unframe: %s", tc.name, err.Error())
+			continue
+		}
+		if msg[0] != tc.m.ID() {
+			t.Errorf("%s: message ID 0x%02X, expected 0x%02X", tc.name, msg[0], tc.m.ID())
+		}
+
+		m, err := Decode(frame)
+		if err != nil {
+			t.Errorf("%s: Decode: %s", tc.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(m, tc.m) {
+			t.Errorf("%s: decoded %+v, expected %+v", tc.name, m, tc.m)
+		}
+
+		if err := Validate(frame); err != nil {
+			t.Errorf("%s: Validate: %s", tc.name, err.Error())
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	traffic := roundTripMessages[1].m.(TrafficReport)
+
+	badCallsign := traffic
+	badCallsign.Callsign = "n12345"
+	if err := Validate(Encode(badCallsign)); err == nil {
+		t.Errorf("lowercase call sign not rejected")
+	}
+
+	badAddrType := traffic
+	badAddrType.AddrType = 6
+	if err := Validate(Encode(badAddrType)); err == nil {
+		t.Errorf("reserved address type not rejected")
+	}
+
+	frame := Encode(traffic)
+	frame[len(frame)-2] ^= 0x01 // CRC.
+	if err := Validate(frame); err == nil {
+		t.Errorf("bad CRC not rejected")
+	}
+
+	if err := Validate(Encode(Heartbeat{Timestamp: 86400})); err == nil {
+		t.Errorf("heartbeat timestamp out of range not rejected")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	validate.go: Strict checks of GDL90 frames against the specification - framing, CRC, message
+	 lengths, and reserved or out of range field values.
+*/
+
+package gdl90
+
+import (
+	"fmt"
+)
+
+// Validate returns an error describing the first problem found in a frame, or nil if the frame
+// conforms to the GDL90 spec. Messages that aren't defined by the spec (vendor extensions) are
+// only checked for framing and CRC.
+func Validate(frame []byte) error {
+	msg, err := Unframe(frame)
+	if err != nil {
+		return err
+	}
+	m, err := Parse(msg)
+	if err != nil {
+		return err
+	}
+
+	switch m := m.(type) {
+	case Heartbeat:
+		if msg[1]&0x02 != 0 || msg[2]&0x1E != 0 || msg[5]&0x04 != 0 {
+			return fmt.Errorf("gdl90: heartbeat reserved bits set")
+		}
+		if m.Timestamp >= 86400 {
+			return fmt.Errorf("gdl90: heartbeat timestamp %d out of range", m.Timestamp)
+		}
+	case UplinkData:
+		if err := validateTimeOfReception(m.TimeOfReception); err != nil {
+			return err
+		}
+	case PassThroughReport:
+		if err := validateTimeOfReception(m.TimeOfReception); err != nil {
+			return err
+		}
+	case TrafficReport:
+		return validateTrafficReport(msg, m)
+	case OwnshipReport:
+		return validateTrafficReport(msg, m.TrafficReport)
+	}
+	return nil
+}
+
+// Time of reception is less than one second in 80 ns units, or all ones if not valid.
+func validateTimeOfReception(tor uint32) error {
+	if tor != TIME_OF_RECEPTION_NA && tor >= 12500000 {
+		return fmt.Errorf("gdl90: time of reception %d out of range", tor)
+	}
+	return nil
+}
+
+func validateTrafficReport(msg []byte, m TrafficReport) error {
+	if s := msg[1] >> 4; s > 1 {
+		return fmt.Errorf("gdl90: reserved traffic alert status %d", s)
+	}
+	if m.AddrType > 5 {
+		return fmt.Errorf("gdl90: reserved address type %d", m.AddrType)
+	}
+	if m.Lat < -90 || m.Lat > 90 {
+		return fmt.Errorf("gdl90: latitude %f out of range", m.Lat)
+	}
+	if m.AltValid && m.Alt > 101350 {
+		return fmt.Errorf("gdl90: altitude %d out of range", m.Alt)
+	}
+	if m.NIC > 11 || m.NACp > 11 {
+		return fmt.Errorf("gdl90: NIC %d or NACp %d out of range", m.NIC, m.NACp)
+	}
+	if m.VvelValid && (m.Vvel > 0x1FE*64 || m.Vvel < -0x1FE*64) {
+		return fmt.Errorf("gdl90: vertical velocity %d out of range", m.Vvel)
+	}
+	if m.Emitter > 39 {
+		return fmt.Errorf("gdl90: emitter category %d out of range", m.Emitter)
+	}
+	// Call sign characters are '0'-'9', 'A'-'Z' and space, plus the lowercase 'e', 'u', 'a', 'r' and
+	// 't' used by the FAA for TIS-B/ADS-R call signs. See GDL90 spec, p.24.
+	for _, c := range msg[19:27] {
+		if c != ' ' && !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') && c != 'e' && c != 'u' && c != 'a' && c != 'r' && c != 't' {
+			return fmt.Errorf("gdl90: invalid call sign character 0x%02X", c)
+		}
+	}
+	if m.Priority > 6 || msg[27]&0x0F != 0 {
+		return fmt.Errorf("gdl90: reserved emergency/priority code %d", m.Priority)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	aircraftjson.go: dump1090-style data/aircraft.json and data/receiver.json, so that standard ADS-B
+	 map frontends (tar1090, the dump1090 web UI) can display the Stratux traffic table, including
+	 UAT and TIS-B targets.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var trafficMessagesTotal uint64 // Number of traffic messages received, all targets. Protected by trafficMutex.
+
+// dump1090 "emergency" values, indexed by GDL90 emergency/priority code.
+var dump1090Emergency = map[uint8]string{
+	0: "none",
+	1: "general",
+	2: "lifeguard",
+	3: "minfuel",
+	4: "nordo",
+	5: "unlawful",
+	6: "downed",
+}
+
+// One entry in aircraft.json. Fields that aren't known are omitted, as dump1090 does.
+type dump1090Aircraft struct {
+	Hex       string      `json:"hex"`
+	Type      string      `json:"type"`
+	Flight    string      `json:"flight,omitempty"`
+	AltBaro   interface{} `json:"alt_baro,omitempty"` // Feet, or "ground".
+	AltGeom   *int32      `json:"alt_geom,omitempty"`
+	Gs        *uint16     `json:"gs,omitempty"`
+	Track     *uint16     `json:"track,omitempty"`
+	BaroRate  *int16      `json:"baro_rate,omitempty"`
+	GeomRate  *int16      `json:"geom_rate,omitempty"`
+	Squawk    string      `json:"squawk,omitempty"`
+	Emergency string      `json:"emergency,omitempty"`
+	Category  string      `json:"category,omitempty"`
+	Lat       *float32    `json:"lat,omitempty"`
+	Lon       *float32    `json:"lon,omitempty"`
+	NIC       *int        `json:"nic,omitempty"`
+	NACp      *int        `json:"nac_p,omitempty"`
+	SeenPos   *float64    `json:"seen_pos,omitempty"`
+	Seen      float64     `json:"seen"`
+	RSSI      *float64    `json:"rssi,omitempty"`
+	Messages  uint32      `json:"messages"`
+}
+
+type dump1090AircraftList struct {
+	Now      float64            `json:"now"`
+	Messages uint64             `json:"messages"`
+	Aircraft []dump1090Aircraft `json:"aircraft"`
+}
+
+type dump1090Receiver struct {
+	Version string   `json:"version"`
+	Refresh int      `json:"refresh"` // Suggested update interval, milliseconds.
+	History int      `json:"history"`
+	Lat     *float32 `json:"lat,omitempty"`
+	Lon     *float32 `json:"lon,omitempty"`
+}
+
+// dump1090AddressType returns the dump1090 "type" of a target, describing its source and address type.
+func dump1090AddressType(ti TrafficInfo) string {
+	switch ti.Addr_type {
+	case 0:
+		switch ti.TargetType {
+		case TARGET_TYPE_MODE_S:
+			return "mode_s"
+		case TARGET_TYPE_ADSR:
+			return "adsr_icao"
+		case TARGET_TYPE_TISB, TARGET_TYPE_TISB_S:
+			return "tisb_icao"
+		}
+		return "adsb_icao"
+	case 1:
+		return "adsb_other"
+	case 2:
+		if ti.TargetType == TARGET_TYPE_ADSR {
+			return "adsr_icao"
+		}
+		return "tisb_icao"
+	case 3:
+		return "tisb_trackfile"
+	case 6:
+		return "adsr_icao"
+	}
+	return "unknown"
+}
+
+// makeDump1090Aircraft converts a target into its aircraft.json entry.
+func makeDump1090Aircraft(ti TrafficInfo) dump1090Aircraft {
+	a := dump1090Aircraft{
+		Hex:      fmt.Sprintf("%06x", ti.Icao_addr),
+		Type:     dump1090AddressType(ti),
+		Seen:     time.Since(ti.Timestamp).Seconds(),
+		Messages: ti.NumMessages,
+	}
+	if ti.Addr_type != 0 && ti.Addr_type != 2 && ti.Addr_type != 6 {
+		a.Hex = "~" + a.Hex // Not an ICAO address.
+	}
+	if len(ti.Tail) > 0 {
+		a.Flight = fmt.Sprintf("%-8s", ti.Tail)
+	}
+
+	if !ti.Last_alt.IsZero() {
+		alt := ti.Alt
+		if ti.AltIsGNSS {
+			a.AltGeom = &alt
+		} else if ti.OnGround {
+			a.AltBaro = "ground"
+		} else {
+			a.AltBaro = alt
+			if stratuxClock.Since(ti.Last_GnssDiff) < 60*time.Second {
+				geom := ti.Alt + ti.GnssDiffFromBaroAlt
+				a.AltGeom = &geom
+			}
+		}
+	}
+	if ti.Speed_valid {
+		gs, trk, vvel := ti.Speed, ti.Track, ti.Vvel
+		a.Gs = &gs
+		a.Track = &trk
+		if ti.AltIsGNSS {
+			a.GeomRate = &vvel
+		} else {
+			a.BaroRate = &vvel
+		}
+	}
+
+	if ti.Squawk != 0 {
+		a.Squawk = fmt.Sprintf("%04d", ti.Squawk)
+	}
+	if e, ok := dump1090Emergency[ti.PriorityStatus]; ok {
+		a.Emergency = e
+	}
+	// Emitter category is A0 = 0x00 ... A7 = 0x07, B0 = 0x08, etc. dump1090 omits the "no information" subcategory 0.
+	if ti.Emitter_category%8 != 0 {
+		a.Category = fmt.Sprintf("%c%d", 'A'+ti.Emitter_category/8, ti.Emitter_category%8)
+	}
+
+	if ti.Position_valid {
+		lat, lon, nic, nacp := ti.Lat, ti.Lng, ti.NIC, ti.NACp
+		seenPos := stratuxClock.Since(ti.Last_seen).Seconds()
+		a.Lat = &lat
+		a.Lon = &lon
+		a.NIC = &nic
+		a.NACp = &nacp
+		a.SeenPos = &seenPos
+	}
+	if ti.SignalLevel > -999 {
+		rssi := ti.SignalLevel
+		a.RSSI = &rssi
+	}
+	return a
+}
+
+// AJAX call - /data/aircraft.json. Responds with the traffic table in dump1090 format.
+// Duplicate tracks and ownship ghosts are not included.
+func handleAircraftJSONRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	list := dump1090AircraftList{
+		Now:      float64(time.Now().UnixNano()) / 1e9,
+		Aircraft: make([]dump1090Aircraft, 0),
+	}
+	trafficMutex.Lock()
+	list.Messages = trafficMessagesTotal
+	for _, ti := range traffic {
+		if ti.DuplicateOf != 0 || ti.OwnshipGhost {
+			continue
+		}
+		list.Aircraft = append(list.Aircraft, makeDump1090Aircraft(withMergedIdentity(ti)))
+	}
+	trafficMutex.Unlock()
+	aircraftJSON, err := json.Marshal(&list)
+	if err != nil {
+		log.Printf("Error sending aircraft.json: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", aircraftJSON)
+}
+
+// AJAX call - /data/receiver.json. Responds with the receiver description used by dump1090 map frontends.
+func handleReceiverJSONRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	rcv := dump1090Receiver{
+		Version: "stratux " + stratuxVersion,
+		Refresh: 1000,
+	}
+	if isGPSValid() {
+		lat, lon := mySituation.GPSLatitude, mySituation.GPSLongitude
+		rcv.Lat = &lat
+		rcv.Lon = &lon
+	}
+	receiverJSON, err := json.Marshal(&rcv)
+	if err != nil {
+		log.Printf("Error sending receiver.json: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", receiverJSON)
+}
@@ -0,0 +1,159 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	alerts.go: Traffic alert events - emergency squawk codes, emergency/priority status, watch list matches.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALERT_TYPE_SQUAWK    = "SQUAWK"
+	ALERT_TYPE_EMERGENCY = "EMERGENCY"
+	ALERT_TYPE_WATCHLIST = "WATCHLIST"
+
+	maxRecentAlerts = 100 // Number of alerts kept to send to new /alerts websocket clients.
+)
+
+type AlertEvent struct {
+	Type           string // ALERT_TYPE_*
+	Message        string
+	Icao_addr      uint32
+	Tail           string
+	Reg            string
+	Squawk         int
+	PriorityStatus uint8
+	Position_valid bool
+	Lat            float32
+	Lng            float32
+	Alt            int32
+	Timestamp      time.Time // time alert was raised, UTC
+}
+
+// Emergency/priority codes as defined in the GDL90 spec, DO-260B (Type 28 msg) and DO-282B.
+var priorityStatusNames = map[uint8]string{
+	1: "general emergency",
+	2: "medical emergency",
+	3: "minimum fuel",
+	4: "no communications",
+	5: "unlawful interference",
+	6: "downed aircraft",
+}
+
+var squawkNames = map[int]string{
+	7500: "hijack",
+	7600: "radio failure",
+	7700: "emergency",
+}
+
+var activeAlerts map[string]bool // Alerts currently raised, keyed by ICAO address and type. Alerts are only sent when first raised.
+var recentAlerts []AlertEvent
+var alertsMutex *sync.Mutex
+
+func alertKey(icao_addr uint32, alertType string) string {
+	return fmt.Sprintf("%06X/%s", icao_addr, alertType)
+}
+
+// isWatchListed returns true if the target tail, registration, or ICAO address matches one of the
+// space separated patterns in settings.WatchList. Patterns use shell wildcards, e.g. "N123*".
+func isWatchListed(ti TrafficInfo) bool {
+	ids := []string{strings.ToUpper(ti.Tail), strings.ToUpper(ti.Reg), fmt.Sprintf("%06X", ti.Icao_addr)}
+	for _, pattern := range strings.Fields(strings.ToUpper(globalSettings.WatchList)) {
+		for _, id := range ids {
+			if len(id) == 0 {
+				continue
+			}
+			if matched, _ := filepath.Match(pattern, id); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trafficAlerts returns the alert conditions currently present for a target.
+func trafficAlerts(ti TrafficInfo) map[string]string {
+	ret := make(map[string]string)
+	if name, ok := squawkNames[ti.Squawk]; ok {
+		ret[ALERT_TYPE_SQUAWK] = fmt.Sprintf("squawking %04d (%s)", ti.Squawk, name)
+	}
+	if ti.PriorityStatus != 0 {
+		name, ok := priorityStatusNames[ti.PriorityStatus]
+		if !ok {
+			name = fmt.Sprintf("priority code %d", ti.PriorityStatus)
+		}
+		ret[ALERT_TYPE_EMERGENCY] = "reporting " + name
+	}
+	if isWatchListed(ti) {
+		ret[ALERT_TYPE_WATCHLIST] = "matches watch list"
+	}
+	return ret
+}
+
+// checkTrafficAlerts raises alert events for new alert conditions in the traffic table.
+// trafficMutex must be locked before calling this function.
+func checkTrafficAlerts() {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	stillActive := make(map[string]bool)
+	for _, ti := range traffic {
+		for alertType, msg := range trafficAlerts(ti) {
+			k := alertKey(ti.Icao_addr, alertType)
+			stillActive[k] = true
+			if activeAlerts[k] {
+				continue
+			}
+			name := ti.Tail
+			if len(name) == 0 {
+				name = fmt.Sprintf("%06X", ti.Icao_addr)
+			}
+			a := AlertEvent{
+				Type:           alertType,
+				Message:        name + " " + msg,
+				Icao_addr:      ti.Icao_addr,
+				Tail:           ti.Tail,
+				Reg:            ti.Reg,
+				Squawk:         ti.Squawk,
+				PriorityStatus: ti.PriorityStatus,
+				Position_valid: ti.Position_valid,
+				Lat:            ti.Lat,
+				Lng:            ti.Lng,
+				Alt:            ti.Alt,
+				Timestamp:      time.Now().UTC(),
+			}
+			registerAlert(a)
+		}
+	}
+	// Conditions that have cleared (or targets that have timed out) can be raised again.
+	activeAlerts = stillActive
+}
+
+// registerAlert sends a new alert to the /alerts websocket and the data log.
+// alertsMutex must be locked before calling this function.
+func registerAlert(a AlertEvent) {
+	log.Printf("traffic alert: %s\n", a.Message)
+	recentAlerts = append(recentAlerts, a)
+	if len(recentAlerts) > maxRecentAlerts {
+		recentAlerts = recentAlerts[len(recentAlerts)-maxRecentAlerts:]
+	}
+	logAlert(a)
+	alertUpdate.SendJSON(a)
+}
+
+func initAlerts() {
+	activeAlerts = make(map[string]bool)
+	recentAlerts = make([]AlertEvent, 0)
+	alertsMutex = &sync.Mutex{}
+}
@@ -0,0 +1,227 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	clientqueue.go: Queue of "queueable" messages (UAT uplinks, basic/long reports) for a client that
+	 isn't accepting messages right now. Uplinks are keyed by product and location, so that a newer copy
+	 of a METAR or NEXRAD block replaces the queued one instead of being sent after it. Text weather is
+	 sent before graphics, and the oldest, lowest priority messages are dropped when the queue is full.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"../uatparse"
+)
+
+// Queue priorities, highest first.
+const (
+	queuePriorityText     = 0 // Text weather (METAR, TAF, winds aloft, PIREP), NOTAMs, AIRMETs/SIGMETs.
+	queuePriorityDefault  = 1 // Basic/long reports, TIS-B/FIS-B products not listed here.
+	queuePriorityGraphics = 2 // NEXRAD and other raster products - large, and quickly replaced.
+	numQueuePriorities    = 3
+)
+
+type queuedMessage struct {
+	msg     []byte
+	keys    []string // Products/locations in the message.
+	live    int      // Number of keys that haven't been superseded by a newer message.
+	removed bool
+}
+
+type clientQueue struct {
+	fifo          [numQueuePriorities][]*queuedMessage
+	owners        map[string]*queuedMessage // Newest queued message for each product/location key.
+	n             int                       // Number of messages queued.
+	nbytes        int                       // Number of bytes queued.
+	tombstones    int                       // Removed messages still in fifo.
+	numDropped    uint32                    // Messages dropped because the queue was over its byte budget.
+	numSuperseded uint32                    // Messages replaced by a newer copy before being sent.
+}
+
+func newClientQueue() *clientQueue {
+	return &clientQueue{owners: make(map[string]*queuedMessage)}
+}
+
+func (q *clientQueue) len() int {
+	return q.n
+}
+
+func (q *clientQueue) bytes() int {
+	return q.nbytes
+}
+
+// remove takes a message out of the queue. It stays in its fifo slice until it reaches the front
+// or the slice is compacted.
+func (q *clientQueue) remove(qm *queuedMessage) {
+	qm.removed = true
+	q.n--
+	q.nbytes -= len(qm.msg)
+	for _, k := range qm.keys {
+		if q.owners[k] == qm {
+			delete(q.owners, k)
+		}
+	}
+}
+
+// push adds a message to the queue. Queued messages whose keys have all been seen again in this
+// message are dropped. If the queue is over maxUserMsgQueueBytes, the oldest messages of the lowest
+// priority are dropped.
+func (q *clientQueue) push(m []byte, keys []string, priority uint8) {
+	if priority >= numQueuePriorities {
+		priority = numQueuePriorities - 1
+	}
+	qm := &queuedMessage{msg: m, keys: keys}
+	for _, k := range keys {
+		old, ok := q.owners[k]
+		if ok && old == qm {
+			continue // Duplicate key.
+		}
+		q.owners[k] = qm
+		qm.live++
+		if ok {
+			old.live--
+			if old.live == 0 {
+				q.remove(old)
+				q.tombstones++
+				q.numSuperseded++
+			}
+		}
+	}
+	q.fifo[priority] = append(q.fifo[priority], qm)
+	q.n++
+	q.nbytes += len(m)
+
+	for p := numQueuePriorities - 1; p >= 0 && q.nbytes > maxUserMsgQueueBytes; p-- {
+		for len(q.fifo[p]) > 0 && q.nbytes > maxUserMsgQueueBytes {
+			qm := q.shift(p)
+			if qm != nil {
+				q.remove(qm)
+				q.numDropped++
+			}
+		}
+	}
+
+	if q.tombstones > 1024 && q.tombstones > q.n {
+		q.compact()
+	}
+}
+
+// shift removes the first entry from a fifo, returning nil if it had already been removed.
+func (q *clientQueue) shift(p int) *queuedMessage {
+	qm := q.fifo[p][0]
+	q.fifo[p][0] = nil
+	q.fifo[p] = q.fifo[p][1:]
+	if qm.removed {
+		q.tombstones--
+		return nil
+	}
+	return qm
+}
+
+// compact drops removed messages from the fifo slices.
+func (q *clientQueue) compact() {
+	for p := range q.fifo {
+		fifo := make([]*queuedMessage, 0, len(q.fifo[p]))
+		for _, qm := range q.fifo[p] {
+			if !qm.removed {
+				fifo = append(fifo, qm)
+			}
+		}
+		q.fifo[p] = fifo
+	}
+	q.tombstones = 0
+}
+
+// pop removes up to 'max' messages from the queue, highest priority first, and returns them in the
+// order they should be sent.
+func (q *clientQueue) pop(max int) [][]byte {
+	var ret [][]byte
+	for p := 0; p < numQueuePriorities && len(ret) < max; p++ {
+		for len(q.fifo[p]) > 0 && len(ret) < max {
+			qm := q.shift(p)
+			if qm != nil {
+				q.remove(qm)
+				ret = append(ret, qm.msg)
+			}
+		}
+	}
+	return ret
+}
+
+// uplinkQueuePriority returns the queue priority of a FIS-B product.
+func uplinkQueuePriority(productID uint32) uint8 {
+	switch {
+	case productID == 413, productID <= 26:
+		return queuePriorityText
+	case productID >= 51 && productID <= 151, productID == 401:
+		return queuePriorityGraphics
+	}
+	return queuePriorityDefault
+}
+
+// uplinkQueueKeys decodes a UAT uplink and returns the products/locations that it contains, and its
+// queue priority. Text reports are keyed by type and location, NEXRAD and other raster products by
+// block. Anything else is keyed by its contents, so that only identical copies are replaced.
+func uplinkQueueKeys(msg []byte) ([]string, uint8) {
+	uatMsg, err := uatparse.New("+" + hex.EncodeToString(msg) + ";")
+	if err != nil {
+		return nil, queuePriorityDefault
+	}
+	if err := uatMsg.DecodeUplink(); err != nil || len(uatMsg.Frames) == 0 {
+		return nil, queuePriorityDefault
+	}
+
+	var keys []string
+	priority := uint8(queuePriorityGraphics)
+	for _, f := range uatMsg.Frames {
+		p := uint8(queuePriorityDefault) // Not FIS-B (TIS-B site ID, reserved).
+		if f.Frame_type == 0 {
+			p = uplinkQueuePriority(f.Product_id)
+		}
+		if p < priority {
+			priority = p
+		}
+
+		var frameKeys []string
+		keyed := f.Frame_type == 0 // Whether all of the frame's contents are covered by frameKeys.
+		if f.Frame_type == 0 {
+			for _, t := range f.Text_data {
+				x := strings.Fields(t)
+				switch {
+				case len(x) == 0:
+				case len(x) < 2:
+					keyed = false
+				case x[0] == "METAR", x[0] == "SPECI":
+					frameKeys = append(frameKeys, "METAR "+x[1])
+				case x[0] == "TAF", x[0] == "TAF.AMD":
+					frameKeys = append(frameKeys, "TAF "+x[1])
+				case x[0] == "WINDS":
+					frameKeys = append(frameKeys, "WINDS "+x[1])
+				default: // PIREPs, ...
+					keyed = false
+				}
+			}
+			for _, b := range f.NEXRAD {
+				frameKeys = append(frameKeys, fmt.Sprintf("NEXRAD %d %d %f %f", b.Radar_Type, b.Scale, b.LatNorth, b.LonWest))
+			}
+			for _, b := range f.Raster {
+				frameKeys = append(frameKeys, fmt.Sprintf("RASTER %d %d %f %f", b.Product_id, b.Scale, b.LatNorth, b.LonWest))
+			}
+		}
+		if !keyed || len(frameKeys) == 0 {
+			h := fnv.New64a()
+			h.Write(f.Raw_data)
+			frameKeys = append(frameKeys, fmt.Sprintf("%d/%d %016x", f.Frame_type, f.Product_id, h.Sum64()))
+		}
+		keys = append(keys, frameKeys...)
+	}
+	return keys, priority
+}
@@ -0,0 +1,261 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	clients.go: Client sessions - per-client statistics, sleep/throttle history and detected app for UDP
+	 and TCP clients, and controls to change a client's capability, reset its queue, or disconnect it.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	maxClientStateHistory = 32              // Sleep/throttle state changes kept per client.
+	clientKickTime        = 5 * time.Minute // Kicked UDP clients aren't reconnected from their DHCP lease for this long.
+)
+
+const (
+	CLIENT_STATE_AWAKE     = "awake"
+	CLIENT_STATE_SLEEPING  = "sleeping"
+	CLIENT_STATE_THROTTLED = "throttled"
+)
+
+type clientStateChange struct {
+	State string
+	Time  time.Time
+}
+
+var clientApps map[string]string       // Detected app by client IP, e.g. "ForeFlight". See ffMonitor().
+var kickedClients map[string]time.Time // UDP clients ('ip:port') kicked with /kickClient, and when.
+
+// Everything known about a client, for /getClientSessions.
+type clientSession struct {
+	Client             string // 'ip:port'. Used to identify the client in /setClientCapability, /kickClient and /resetClientQueue.
+	Protocol           string // "udp" or "tcp".
+	Ip                 string
+	Port               uint32
+	Kind               uint8 // NETWORK_OUTPUT_*. UDP only.
+	Hostname           string
+	App                string
+	Capability         uint8
+	CapabilityOverride bool
+	Connected          time.Time
+	MessagesSent       uint64
+	BytesSent          uint64
+	QueueMessages      int
+	QueueBytes         int
+	MessagesSuperseded uint32 // Queued messages replaced by a newer copy.
+	MessagesDropped    uint32 // Messages dropped because the queue was full.
+	State              string
+	StateHistory       []clientStateChange
+}
+
+// updateClientState records sleep/throttle state changes of a UDP client.
+// ***WARNING***: netMutex must be locked before calling this function.
+func updateClientState(netconn *networkConnection) {
+	state := CLIENT_STATE_AWAKE
+	if netconn.SleepFlag {
+		state = CLIENT_STATE_SLEEPING
+	} else if netconn.Kind == NETWORK_OUTPUT_UNICAST && stratuxClock.Since(netconn.LastUnreachable) < (15*time.Second) {
+		// Same as isThrottled(), without the random 0.1%.
+		state = CLIENT_STATE_THROTTLED
+	}
+	if n := len(netconn.stateHistory); n > 0 && netconn.stateHistory[n-1].State == state {
+		return
+	}
+	netconn.stateHistory = append(netconn.stateHistory, clientStateChange{State: state, Time: time.Now()})
+	if len(netconn.stateHistory) > maxClientStateHistory {
+		netconn.stateHistory = netconn.stateHistory[1:]
+	}
+}
+
+// isKicked returns true if a UDP client was kicked recently.
+// ***WARNING***: netMutex must be locked before calling this function.
+func isKicked(k string) bool {
+	t, ok := kickedClients[k]
+	if ok && time.Since(t) >= clientKickTime {
+		delete(kickedClients, k)
+		return false
+	}
+	return ok
+}
+
+func getClientSessions() []clientSession {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+
+	ret := make([]clientSession, 0)
+	for k, netconn := range outSockets {
+		c := clientSession{
+			Client:             k,
+			Protocol:           "udp",
+			Ip:                 netconn.Ip,
+			Port:               netconn.Port,
+			Kind:               netconn.Kind,
+			Hostname:           dhcpLeases[netconn.Ip],
+			App:                clientApps[netconn.Ip],
+			Capability:         netconn.Capability,
+			CapabilityOverride: netconn.capabilityOverride,
+			Connected:          netconn.connected,
+			MessagesSent:       netconn.messagesSent,
+			BytesSent:          netconn.bytesSent,
+			QueueMessages:      netconn.messageQueue.len(),
+			QueueBytes:         netconn.messageQueue.bytes(),
+			MessagesSuperseded: netconn.messageQueue.numSuperseded,
+			MessagesDropped:    netconn.messageQueue.numDropped,
+			StateHistory:       append([]clientStateChange{}, netconn.stateHistory...),
+		}
+		if n := len(c.StateHistory); n > 0 {
+			c.State = c.StateHistory[n-1].State
+		}
+		ret = append(ret, c)
+	}
+	for k, tcpconn := range tcpOutSockets {
+		q := tcpconn.queue
+		q.mu.Lock()
+		c := clientSession{
+			Client:             k,
+			Protocol:           "tcp",
+			Ip:                 tcpconn.Ip,
+			Port:               tcpconn.Port,
+			Hostname:           dhcpLeases[tcpconn.Ip],
+			App:                clientApps[tcpconn.Ip],
+			Capability:         tcpconn.Capability,
+			CapabilityOverride: tcpconn.capabilityOverride,
+			Connected:          tcpconn.connected,
+			MessagesSent:       q.messagesSent,
+			BytesSent:          q.bytesSent,
+			QueueMessages:      len(q.realtime) + q.queued.len(),
+			QueueBytes:         q.queued.bytes(),
+			MessagesSuperseded: q.queued.numSuperseded,
+			MessagesDropped:    q.numDropped + q.queued.numDropped,
+			State:              CLIENT_STATE_AWAKE, // Flow control, no sleep mode.
+		}
+		for _, m := range q.realtime {
+			c.QueueBytes += len(m)
+		}
+		q.mu.Unlock()
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Client < ret[j].Client })
+	return ret
+}
+
+// AJAX call - /getClientSessions. Responds with statistics for all UDP and TCP clients.
+func handleClientSessionsGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	sessionsJSON, _ := json.Marshal(getClientSessions())
+	fmt.Fprintf(w, "%s\n", sessionsJSON)
+}
+
+// readClientRequest reads a client control request, {"Client":"192.168.10.10:4000", ...}. Returns false
+// (after responding with an error) if the request isn't a valid POST.
+func readClientRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	setNoCache(w)
+	setJSONHeaders(w)
+	w.Header().Set("Access-Control-Allow-Method", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	// For an OPTION method request, we return header without processing.
+	if r.Method != "POST" {
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err.Error()), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// AJAX call - /setClientCapability. Changes the message types sent to a client until it disconnects,
+// e.g. {"Client":"192.168.10.10:4000","Capability":5}. Settings changes don't override it.
+func handleClientCapabilityRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Client     string
+		Capability uint8
+	}
+	if !readClientRequest(w, r, &req) {
+		return
+	}
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	if netconn, ok := outSockets[req.Client]; ok {
+		netconn.Capability = req.Capability
+		netconn.capabilityOverride = true
+		outSockets[req.Client] = netconn
+	} else if tcpconn, ok := tcpOutSockets[req.Client]; ok {
+		tcpconn.Capability = req.Capability
+		tcpconn.capabilityOverride = true
+		tcpOutSockets[req.Client] = tcpconn
+	} else {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	log.Printf("client %s capability set to %d.\n", req.Client, req.Capability)
+}
+
+// AJAX call - /resetClientQueue. Discards the messages queued for a client, {"Client":"192.168.10.10:4000"}.
+func handleClientQueueResetRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Client string
+	}
+	if !readClientRequest(w, r, &req) {
+		return
+	}
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	if netconn, ok := outSockets[req.Client]; ok {
+		netconn.messageQueue = newClientQueue()
+		netconn.MessageQueueLen = 0
+		outSockets[req.Client] = netconn
+	} else if tcpconn, ok := tcpOutSockets[req.Client]; ok {
+		q := tcpconn.queue
+		q.mu.Lock()
+		q.realtime = nil
+		q.queued = newClientQueue()
+		q.mu.Unlock()
+	} else {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	log.Printf("client %s queue reset.\n", req.Client)
+}
+
+// AJAX call - /kickClient. Disconnects a client, {"Client":"192.168.10.10:4000"}. TCP clients may
+// reconnect right away. UDP clients aren't reconnected from their DHCP lease (or static IP) for
+// clientKickTime. Broadcast and multicast outputs are reopened on the next refresh.
+func handleClientKickRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Client string
+	}
+	if !readClientRequest(w, r, &req) {
+		return
+	}
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	if netconn, ok := outSockets[req.Client]; ok {
+		netconn.Conn.Close()
+		delete(outSockets, req.Client)
+		if netconn.Kind == NETWORK_OUTPUT_UNICAST {
+			kickedClients[req.Client] = time.Now()
+		}
+	} else if tcpconn, ok := tcpOutSockets[req.Client]; ok {
+		tcpconn.queue.close() // tcpOutWriter() closes the connection.
+		tcpconn.Conn.Close()  // Interrupt a blocked write.
+		delete(tcpOutSockets, req.Client)
+	} else {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	log.Printf("client %s kicked.\n", req.Client)
+}
@@ -0,0 +1,122 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	conflict.go: Closest point of approach (CPA) calculation and traffic alert logic.
+*/
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	KNOTS_TO_MPS = 1852.0 / 3600.0 // knots to meters per second.
+	NM_TO_METERS = 1852.0
+)
+
+// ownshipVelocity returns the north and east components of ownship velocity in meters per second.
+func ownshipVelocity() (velN, velE float64) {
+	if !isGPSGroundTrackValid() {
+		return 0, 0
+	}
+	gs := mySituation.GPSGroundSpeed * KNOTS_TO_MPS
+	trk := radians(float64(mySituation.GPSTrueCourse))
+	return gs * math.Cos(trk), gs * math.Sin(trk)
+}
+
+// ownshipAltitude returns ownship altitude (feet) and vertical speed (feet per minute) on the same
+// reference as the target's reported altitude - pressure altitude if available and the target is
+// reporting pressure altitude, GPS MSL altitude otherwise.
+func ownshipAltitude(ti TrafficInfo) (alt, vvel float64) {
+	if !ti.AltIsGNSS && isTempPressValid() {
+		alt = float64(mySituation.BaroPressureAltitude)
+		if mySituation.BaroVerticalSpeed != 99999 {
+			vvel = float64(mySituation.BaroVerticalSpeed)
+		}
+		return
+	}
+	return float64(mySituation.GPSAltitudeMSL), float64(mySituation.GPSVerticalSpeed) * 60.0
+}
+
+// computeCPA calculates time, horizontal distance, and relative altitude at the closest point of
+// approach between ownship and the target, assuming both continue at their present velocities,
+// and sets the TrafficAlert flag if the thresholds from globalSettings are exceeded.
+// The target position is dead-reckoned to the current time if it is being coasted.
+func computeCPA(ti TrafficInfo) TrafficInfo {
+	ti.CPA_valid = false
+	ti.CPA_time = 0
+	ti.CPA_distance = 0
+	ti.CPA_alt = 0
+	ti.TrafficAlert = false
+
+	if !ti.Position_valid || !isGPSValid() {
+		// No way to tell where the target is relative to ownship.
+		return ti
+	}
+
+	cur := ti
+	if ti.Age > 2 && isTrafficCoastable(ti) {
+		cur = coastTraffic(ti)
+	}
+
+	// Relative position and velocity of the target, in meters and meters per second.
+	_, _, posN, posE := distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(cur.Lat), float64(cur.Lng))
+	var velN, velE float64
+	if ti.Speed_valid {
+		gs := float64(ti.Speed) * KNOTS_TO_MPS
+		trk := radians(float64(ti.Track))
+		velN = gs * math.Cos(trk)
+		velE = gs * math.Sin(trk)
+	}
+	ownN, ownE := ownshipVelocity()
+	velN -= ownN
+	velE -= ownE
+
+	// Time to CPA. If the target is diverging (or relative velocity is zero), CPA is now.
+	var tCPA float64
+	v2 := velN*velN + velE*velE
+	if v2 > 0.01 {
+		tCPA = -(posN*velN + posE*velE) / v2
+	}
+	if tCPA < 0 {
+		tCPA = 0
+	}
+
+	cpaN := posN + velN*tCPA
+	cpaE := posE + velE*tCPA
+	ti.CPA_time = tCPA
+	ti.CPA_distance = math.Sqrt(cpaN*cpaN + cpaE*cpaE)
+	ti.CPA_valid = true
+
+	// Vertical separation at CPA. If the target altitude is unknown, only use horizontal geometry.
+	altValid := ti.AgeLastAlt < 60
+	relAltNow := 0.0
+	if altValid {
+		ownAlt, ownVvel := ownshipAltitude(ti)
+		relAltNow = float64(cur.Alt) - ownAlt
+		relVvel := float64(ti.Vvel) - ownVvel
+		ti.CPA_alt = int32(relAltNow + relVvel*tCPA/60.0)
+	}
+
+	altThreshold := float64(globalSettings.TrafficAlertAltitude)
+
+	// Proximity alert - target is close now.
+	dist := math.Sqrt(posN*posN + posE*posE)
+	if dist < globalSettings.TrafficAlertProximity*NM_TO_METERS &&
+		(!altValid || math.Abs(relAltNow) < altThreshold) {
+		ti.TrafficAlert = true
+	}
+
+	// Conflict alert - target will be close within the look-ahead time.
+	if tCPA <= float64(globalSettings.TrafficAlertTime) &&
+		ti.CPA_distance < globalSettings.TrafficAlertDistance*NM_TO_METERS &&
+		(!altValid || math.Abs(float64(ti.CPA_alt)) < altThreshold) {
+		ti.TrafficAlert = true
+	}
+
+	return ti
+}
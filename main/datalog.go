@@ -20,6 +20,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -208,7 +209,7 @@ func makeTable(i interface{}, tbl string, db *sql.DB) {
 		fields = append(fields, "timestamp_id INTEGER")
 	}
 
-	tblCreate := fmt.Sprintf("CREATE TABLE %s (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, %s)", tbl, strings.Join(fields, ", "))
+	tblCreate := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, %s)", tbl, strings.Join(fields, ", "))
 
 	_, err := db.Exec(tblCreate)
 	if err != nil {
@@ -356,6 +357,7 @@ var shutdownDataLog chan bool
 var shutdownDataLogWriter chan bool
 
 var dataLogWriteChan chan DataLogRow
+var dataLogRowsQueuedForWrite int32 // Rows waiting for the next write in dataLogWriter(). Accessed atomically.
 
 func dataLogWriter(db *sql.DB) {
 	dataLogWriteChan = make(chan DataLogRow, 10240)
@@ -369,6 +371,7 @@ func dataLogWriter(db *sql.DB) {
 		case r := <-dataLogWriteChan:
 			// Accept timestamped row.
 			rowsQueuedForWrite = append(rowsQueuedForWrite, r)
+			atomic.StoreInt32(&dataLogRowsQueuedForWrite, int32(len(rowsQueuedForWrite)))
 		case <-writeTicker.C:
 			//			for i := 0; i < 1000; i++ {
 			//				logSituation()
@@ -398,6 +401,7 @@ func dataLogWriter(db *sql.DB) {
 			// Close the transaction.
 			tx.Commit()
 			rowsQueuedForWrite = make([]DataLogRow, 0) // Zero the queue.
+			atomic.StoreInt32(&dataLogRowsQueuedForWrite, 0)
 			timeElapsed := stratuxClock.Since(timeStart)
 			if globalSettings.DEBUG {
 				rowsPerSecond := float64(nRows) / float64(timeElapsed.Seconds())
@@ -477,6 +481,8 @@ func dataLog() {
 		makeTable(gpsPerfStats{}, "gps_attitude", db)
 		makeTable(StratuxStartup{}, "startup", db)
 	}
+	// Added after the other tables, so it may be missing from an existing database.
+	makeTable(AlertEvent{}, "alerts", db)
 
 	// The first entry to be created is the "startup" entry.
 	stratuxStartupID = insertData(StratuxStartup{}, "startup", db, 0)
@@ -574,6 +580,12 @@ func logGPSAttitude(gpsPerf gpsPerfStats) {
 	}
 }
 
+func logAlert(a AlertEvent) {
+	if globalSettings.ReplayLog && isDataLogReady() {
+		dataLogChan <- DataLogRow{tbl: "alerts", data: a}
+	}
+}
+
 func logDump1090TermMessage(m Dump1090TermMessage) {
 	if globalSettings.DEBUG && globalSettings.ReplayLog && isDataLogReady() {
 		dataLogChan <- DataLogRow{tbl: "dump1090_terminal", data: m}
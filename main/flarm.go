@@ -0,0 +1,213 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flarm.go: FLARM NMEA ($PFLAA, $PFLAU) traffic output and $GPRMC/$GPGGA ownship sentences, for
+	 XCSoar, LK8000, SkyDemon, and other apps that read FLARM data rather than GDL90.
+	 See the FLARM "Data Port Specification".
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	FEET_TO_METERS = 0.3048
+	FPM_TO_MPS     = 0.3048 / 60.0
+)
+
+// FLARM aircraft type codes indexed by GDL90 emitter category. Unmapped categories are "unknown" (A).
+var flarmAircraftType = map[uint8]string{
+	1:  "8", // Light - piston.
+	2:  "9", // Small.
+	3:  "9", // Large.
+	4:  "9", // High vortex large.
+	5:  "9", // Heavy.
+	6:  "9", // Highly maneuverable.
+	7:  "3", // Rotorcraft.
+	9:  "1", // Glider.
+	10: "B", // Lighter than air.
+	11: "4", // Parachutist.
+	12: "6", // Ultralight / hang glider.
+	14: "D", // UAV.
+}
+
+// flarmAlarmLevel converts the traffic alert and time to closest point of approach into a FLARM
+// alarm level: 0 = no alarm, 1 = 15-20 s to impact, 2 = 10-15 s, 3 = less than 10 s.
+func flarmAlarmLevel(ti TrafficInfo) int {
+	if !ti.TrafficAlert {
+		return 0
+	}
+	switch {
+	case ti.CPA_time < 10:
+		return 3
+	case ti.CPA_time < 15:
+		return 2
+	}
+	return 1
+}
+
+// flarmRelativePosition returns position of the target relative to ownship: north, east and
+// vertical (positive above) in meters. ok is false if ownship position isn't known.
+func flarmRelativePosition(ti TrafficInfo) (north, east, vertical float64, altValid, ok bool) {
+	if !isGPSValid() || !ti.Position_valid {
+		return 0, 0, 0, false, false
+	}
+	_, _, north, east = distRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	if ti.AgeLastAlt < 60 {
+		ownAlt, _ := ownshipAltitude(ti)
+		vertical = (float64(ti.Alt) - ownAlt) * FEET_TO_METERS
+		altValid = true
+	}
+	return north, east, vertical, altValid, true
+}
+
+// flarmID returns the ID type and ID fields for a target. ID type 1 is an ICAO address, 0 is random (non-ICAO).
+func flarmID(ti TrafficInfo) (int, string) {
+	idType := 1
+	if ti.Addr_type != 0 && ti.Addr_type != 2 && ti.Addr_type != 6 {
+		idType = 0
+	}
+	return idType, fmt.Sprintf("%06X", ti.Icao_addr)
+}
+
+// makeFLARMPFLAAString creates a $PFLAA sentence (data on other aircraft) for a target.
+func makeFLARMPFLAAString(ti TrafficInfo) (string, bool) {
+	north, east, vertical, altValid, ok := flarmRelativePosition(ti)
+	if !ok {
+		return "", false
+	}
+	rv := ""
+	if altValid {
+		rv = fmt.Sprintf("%d", int(vertical))
+	}
+	idType, id := flarmID(ti)
+	trk, gs, climb := "", "", ""
+	if ti.Speed_valid {
+		trk = fmt.Sprintf("%d", ti.Track)
+		gs = fmt.Sprintf("%d", int(float64(ti.Speed)*KNOTS_TO_MPS))
+		climb = fmt.Sprintf("%.1f", float64(ti.Vvel)*FPM_TO_MPS)
+	}
+	acType, ok := flarmAircraftType[ti.Emitter_category]
+	if !ok {
+		acType = "A"
+	}
+	// PFLAA,<AlarmLevel>,<RelativeNorth>,<RelativeEast>,<RelativeVertical>,<IDType>,<ID>,<Track>,<TurnRate>,<GroundSpeed>,<ClimbRate>,<AcftType>
+	return fmt.Sprintf("PFLAA,%d,%d,%d,%s,%d,%s,%s,,%s,%s,%s", flarmAlarmLevel(ti), int(north), int(east), rv, idType, id, trk, gs, climb, acType), true
+}
+
+// makeFLARMPFLAUString creates a $PFLAU sentence (heartbeat, status, and most important target).
+// The most important target is the alerted target with the least time to closest point of
+// approach, or the nearest target if there are no alerts.
+func makeFLARMPFLAUString(targets []TrafficInfo) string {
+	gpsStatus := 0
+	if isGPSValid() {
+		gpsStatus = 2 // 3D fix, airborne.
+	}
+
+	var threat TrafficInfo
+	found := false
+	for _, ti := range targets {
+		if _, _, _, _, ok := flarmRelativePosition(ti); !ok {
+			continue
+		}
+		if !found ||
+			(ti.TrafficAlert && (!threat.TrafficAlert || ti.CPA_time < threat.CPA_time)) ||
+			(!ti.TrafficAlert && !threat.TrafficAlert && ti.Distance < threat.Distance) {
+			threat = ti
+			found = true
+		}
+	}
+
+	// PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,<AlarmType>,<RelativeVertical>,<RelativeDistance>,<ID>
+	if !found {
+		return fmt.Sprintf("PFLAU,%d,1,%d,1,0,,0,,,", len(targets), gpsStatus)
+	}
+	north, east, vertical, altValid, _ := flarmRelativePosition(threat)
+	bearing := degrees(math.Atan2(east, north)) - float64(mySituation.GPSTrueCourse)
+	for bearing > 180 {
+		bearing -= 360
+	}
+	for bearing < -180 {
+		bearing += 360
+	}
+	alarmType := 0
+	level := flarmAlarmLevel(threat)
+	if level > 0 {
+		alarmType = 2 // Aircraft traffic.
+	}
+	rv := ""
+	if altValid {
+		rv = fmt.Sprintf("%d", int(vertical))
+	}
+	_, id := flarmID(threat)
+	return fmt.Sprintf("PFLAU,%d,1,%d,1,%d,%d,%d,%s,%d,%s", len(targets), gpsStatus, level, int(bearing), alarmType, rv, int(math.Sqrt(north*north+east*east)), id)
+}
+
+// nmeaLatLng formats a coordinate as NMEA (d)ddmm.mmmm,H.
+func nmeaLatLng(v float32, degDigits int, pos, neg string) string {
+	hemi := pos
+	if v < 0 {
+		hemi = neg
+		v = -v
+	}
+	deg := math.Floor(float64(v))
+	min := math.Floor((float64(v)-deg)*60*10000+0.5) / 10000 // Round to the printed precision first, so 59.99999 becomes 1 degree and 00.0000.
+	if min >= 60 {
+		deg++
+		min -= 60
+	}
+	return fmt.Sprintf("%0*d%07.4f,%s", degDigits, int(deg), min, hemi)
+}
+
+// makeGPRMCString creates a $GPRMC sentence (recommended minimum GPS data) from mySituation.
+func makeGPRMCString() string {
+	t := mySituation.GPSTime
+	status := "V"
+	if isGPSValid() {
+		status = "A"
+	}
+	return fmt.Sprintf("GPRMC,%s,%s,%s,%s,%.1f,%.1f,%s,,",
+		t.Format("150405.00"), status,
+		nmeaLatLng(mySituation.GPSLatitude, 2, "N", "S"), nmeaLatLng(mySituation.GPSLongitude, 3, "E", "W"),
+		mySituation.GPSGroundSpeed, mySituation.GPSTrueCourse, t.Format("020106"))
+}
+
+// makeGPGGAString creates a $GPGGA sentence (GPS fix data) from mySituation.
+func makeGPGGAString() string {
+	fixQuality := 0
+	if isGPSValid() {
+		fixQuality = int(mySituation.GPSFixQuality)
+	}
+	hdop := math.Max(float64(mySituation.GPSHorizontalAccuracy)/4.0, 0.5) // Rough conversion from 95% accuracy.
+	return fmt.Sprintf("GPGGA,%s,%s,%s,%d,%02d,%.1f,%.1f,M,%.1f,M,,",
+		mySituation.GPSTime.Format("150405.00"),
+		nmeaLatLng(mySituation.GPSLatitude, 2, "N", "S"), nmeaLatLng(mySituation.GPSLongitude, 3, "E", "W"),
+		fixQuality, mySituation.GPSSatellites, hdop,
+		float64(mySituation.GPSAltitudeMSL)*FEET_TO_METERS, float64(mySituation.GPSGeoidSep)*FEET_TO_METERS)
+}
+
+// sendFLARMUpdates sends ownship GPS data and FLARM traffic sentences to clients configured for
+// FLARM NMEA output, and the GPS sentences alone to clients configured for GPS NMEA output. Called
+// once per second with the targets that are sent as GDL90 traffic.
+func sendFLARMUpdates(targets []TrafficInfo) {
+	var gpsMsg []byte
+	if isGPSValid() {
+		gpsMsg = append(gpsMsg, makeNMEACmd(makeGPRMCString())...)
+		gpsMsg = append(gpsMsg, makeNMEACmd(makeGPGGAString())...)
+		sendMsg(gpsMsg, NETWORK_GPS_NMEA, false)
+	}
+	msg := append([]byte{}, gpsMsg...)
+	msg = append(msg, makeNMEACmd(makeFLARMPFLAUString(targets))...)
+	for _, ti := range targets {
+		if s, ok := makeFLARMPFLAAString(ti); ok {
+			msg = append(msg, makeNMEACmd(s)...)
+		}
+	}
+	sendMsg(msg, NETWORK_FLARM_NMEA, false)
+}
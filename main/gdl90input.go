@@ -0,0 +1,271 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gdl90input.go: GDL90 input from another receiver (certified ADS-B In box, second Stratux) over UDP
+	 or serial. Traffic and ownship reports are merged into the traffic table; uplinks and basic/long
+	 reports go through the same parseInput() path as messages from our own UAT radio.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"../gdl90"
+	"github.com/tarm/serial"
+)
+
+// Traffic received directly by our own radios within this time isn't overwritten by GDL90 input.
+const gdl90InputLocalPriority = 3 * time.Second
+
+// gdl90TargetType converts a GDL90 traffic report address type into a TARGET_TYPE_*.
+func gdl90TargetType(addrType uint8) uint8 {
+	switch addrType {
+	case 2: // TIS-B with ICAO address.
+		return TARGET_TYPE_TISB_S
+	case 3: // TIS-B with track file ID.
+		return TARGET_TYPE_TISB
+	}
+	return TARGET_TYPE_ADSB
+}
+
+// updateTrafficFromGDL90 merges a traffic or ownship report from GDL90 input into the traffic table.
+func updateTrafficFromGDL90(r gdl90.TrafficReport) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	ti, ok := traffic[r.Address]
+	if !ok {
+		ti.Last_seen = stratuxClock.Time // need to initialize to current stratuxClock so it doesn't get cut before we have a chance to populate a position message
+		ti.Icao_addr = r.Address
+		ti.SignalLevel = -999
+		if r.AddrType == 0 || r.AddrType == 2 {
+			if reg, validReg := icao2reg(r.Address); validReg {
+				ti.Reg = reg
+				ti.Tail = reg
+			}
+		}
+	}
+
+	// Only fill in missing information if one of our own radios is receiving this target.
+	if ok && ti.Last_source != TRAFFIC_SOURCE_GDL90 && stratuxClock.Since(ti.Last_seen) < gdl90InputLocalPriority {
+		if len(ti.Tail) == 0 {
+			ti.Tail = r.Callsign
+		}
+		if ti.Emitter_category == 0 {
+			ti.Emitter_category = r.Emitter
+		}
+		traffic[ti.Icao_addr] = ti
+		return
+	}
+
+	ti.Addr_type = r.AddrType
+	ti.TargetType = gdl90TargetType(r.AddrType)
+	if len(r.Callsign) > 0 {
+		ti.Tail = r.Callsign
+	}
+	if r.Emitter != 0 {
+		ti.Emitter_category = r.Emitter
+	}
+	ti.OnGround = !r.Airborne
+	ti.PriorityStatus = r.Priority
+	ti.NIC = int(r.NIC)
+	ti.NACp = int(r.NACp)
+
+	// Latitude and longitude are zero with NIC zero if there is no position. Extrapolated positions
+	// aren't used - the target is coasted here instead.
+	if !r.Extrapolated && !(r.Lat == 0 && r.Lng == 0 && r.NIC == 0) {
+		ti.Lat = r.Lat
+		ti.Lng = r.Lng
+		ti.Position_valid = true
+		ti.ExtrapolatedPosition = false
+		ti.Last_seen = stratuxClock.Time
+	}
+	if r.AltValid {
+		ti.Alt = r.Alt
+		ti.AltIsGNSS = false
+		ti.Last_alt = stratuxClock.Time
+	}
+	if r.SpeedValid && r.TrackType != gdl90.TRACK_TYPE_INVALID {
+		ti.Speed = r.Speed
+		ti.Track = uint16(r.Track+0.5) % 360
+		ti.Speed_valid = true
+		ti.Last_speed = stratuxClock.Time
+	}
+	if r.VvelValid {
+		ti.Vvel = r.Vvel
+	}
+
+	ti.Timestamp = time.Now()
+	ti.Last_source = TRAFFIC_SOURCE_GDL90
+	ti.NumMessages++
+	trafficMessagesTotal++
+
+	traffic[ti.Icao_addr] = ti
+	registerTrafficUpdate(ti)
+	seenTraffic[ti.Icao_addr] = true // Mark as seen.
+}
+
+// updateOwnshipFromGDL90 handles an ownship report from GDL90 input. The other receiver knows the
+// ownship ICAO address, so use it as the ownship address and track ownship like any other target.
+// The address is kept apart from auto-detection, which drops its address whenever correlation with
+// GPS isn't possible, e.g. on the ground.
+func updateOwnshipFromGDL90(r gdl90.OwnshipReport) {
+	if r.AddrType != 0 || !isOwnshipCodeValid(r.Address) {
+		return // Other receiver doesn't know the ownship address.
+	}
+	trafficMutex.Lock()
+	if ownshipGDL90InputCode != r.Address || stratuxClock.Since(ownshipGDL90InputLast) >= ownshipGDL90InputTime*time.Second {
+		log.Printf("ownship address from GDL90 input: %06X\n", r.Address)
+	}
+	ownshipGDL90InputCode = r.Address
+	ownshipGDL90InputLast = stratuxClock.Time
+	code, codeValid := getOwnshipCode()
+	trafficMutex.Unlock()
+	// Otherwise (OwnshipModeS set to a different address) it would show up as traffic.
+	if codeValid && code == r.Address {
+		updateTrafficFromGDL90(r.TrafficReport)
+	}
+}
+
+// relayGDL90InputUAT sends a UAT uplink or basic/long report payload through parseInput(), as if
+// it had been received by our own UAT radio.
+func relayGDL90InputUAT(prefix string, payload []byte) {
+	o, msgtype := parseInput(prefix + hex.EncodeToString(payload) + ";")
+	if o != nil && msgtype != 0 {
+		relayMessage(msgtype, o)
+	}
+}
+
+func handleGDL90InputFrame(frame []byte) {
+	m, err := gdl90.Decode(frame)
+	if err != nil {
+		globalStatus.GDL90Input_errors_total++
+		if globalSettings.DEBUG {
+			log.Printf("GDL90 input: %s\n", err.Error())
+		}
+		return
+	}
+	globalStatus.GDL90Input_messages_total++
+	if globalSettings.DEBUG {
+		// Decoded, but may still not be to spec. Helps when bringing up a new input device.
+		if err := gdl90.Validate(frame); err != nil {
+			log.Printf("GDL90 input: %s\n", err.Error())
+		}
+	}
+
+	switch m := m.(type) {
+	case gdl90.TrafficReport:
+		updateTrafficFromGDL90(m)
+	case gdl90.OwnshipReport:
+		updateOwnshipFromGDL90(m)
+	case gdl90.UplinkData:
+		relayGDL90InputUAT("+", m.Payload)
+	case gdl90.PassThroughReport:
+		relayGDL90InputUAT("-", m.Payload)
+	}
+}
+
+func gdl90InputUDPReader(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return // Closed.
+		}
+		// A datagram may contain several frames.
+		scanner := bufio.NewScanner(bytes.NewReader(buf[:n]))
+		scanner.Split(gdl90.ScanFrames)
+		for scanner.Scan() {
+			handleGDL90InputFrame(scanner.Bytes())
+		}
+	}
+}
+
+func gdl90InputSerialReader(p *serial.Port, done chan<- bool) {
+	scanner := bufio.NewScanner(p)
+	scanner.Split(gdl90.ScanFrames)
+	for scanner.Scan() {
+		handleGDL90InputFrame(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("GDL90 input serial port closed: %s\n", err.Error())
+	}
+	p.Close()
+	done <- true
+}
+
+// gdl90InputWatcher opens and closes the GDL90 input UDP port and serial device as settings change,
+// and reopens the serial device if it is unplugged.
+func gdl90InputWatcher() {
+	var udpConn *net.UDPConn
+	var udpPort int
+	var serialPort *serial.Port
+	var serialDev string
+	var serialBaud int
+	var serialDone chan bool // Signalled by the reader when the device is closed. Nil if the device isn't open.
+
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		// UDP.
+		wantPort := globalSettings.GDL90InputUDPPort
+		if udpConn != nil && wantPort != udpPort {
+			log.Printf("closing GDL90 input on UDP port %d.\n", udpPort)
+			udpConn.Close()
+			udpConn = nil
+		}
+		if udpConn == nil && wantPort != 0 {
+			addr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(wantPort))
+			if err == nil {
+				udpConn, err = net.ListenUDP("udp", addr)
+			}
+			if err != nil {
+				addSingleSystemErrorf("gdl90-input", "Can't listen for GDL90 input on UDP port %d: %s", wantPort, err.Error())
+			} else {
+				log.Printf("GDL90 input listening on UDP port %d.\n", wantPort)
+				udpPort = wantPort
+				go gdl90InputUDPReader(udpConn)
+			}
+		}
+
+		// Serial.
+		wantDev, wantBaud := globalSettings.GDL90InputDevice, globalSettings.GDL90InputBaud
+		if serialPort != nil && (wantDev != serialDev || wantBaud != serialBaud) {
+			log.Printf("closing GDL90 input on %s.\n", serialDev)
+			serialPort.Close() // The reader exits on its own.
+			serialPort = nil
+			serialDone = nil
+		}
+		if serialPort == nil && len(wantDev) > 0 {
+			p, err := serial.OpenPort(&serial.Config{Name: wantDev, Baud: wantBaud})
+			if err == nil {
+				log.Printf("GDL90 input opened %s at %d baud.\n", wantDev, wantBaud)
+				serialPort, serialDev, serialBaud = p, wantDev, wantBaud
+				serialDone = make(chan bool, 1)
+				go gdl90InputSerialReader(p, serialDone)
+			}
+			// Not logged - the device may not be plugged in yet.
+		}
+
+		select {
+		case <-ticker.C:
+		case <-serialDone:
+			serialPort = nil // Unplugged. Try to reopen on the next pass.
+			serialDone = nil
+			<-ticker.C
+		}
+	}
+}
+
+func initGDL90Input() {
+	go gdl90InputWatcher()
+}
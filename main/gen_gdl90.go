@@ -29,9 +29,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"../gdl90"
 	"../uatparse"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/ricochet2200/go-disk-usage/du"
@@ -51,10 +53,10 @@ const (
 	debugLogFile   = "stratux.log"
 	dataLogFile    = "stratux.sqlite"
 	//FlightBox: log to /root.
-	logDir_FB           = "/root/"
-	wifiConfigLocation  = "/etc/hostapd/hostapd.user"
-	maxDatagramSize     = 8192
-	maxUserMsgQueueSize = 25000 // About 10MB per port per connected client.
+	logDir_FB            = "/root/"
+	wifiConfigLocation   = "/etc/hostapd/hostapd.user"
+	maxDatagramSize      = 8192
+	maxUserMsgQueueBytes = 10 * 1024 * 1024 // Queued messages per port per connected client. See clientqueue.go.
 
 	UPLINK_BLOCK_DATA_BITS  = 576
 	UPLINK_BLOCK_BITS       = (UPLINK_BLOCK_DATA_BITS + 160)
@@ -78,9 +80,6 @@ const (
 	MSGCLASS_UAT = 0
 	MSGCLASS_ES  = 1
 
-	LON_LAT_RESOLUTION = float32(180.0 / 8388608.0)
-	TRACK_RESOLUTION   = float32(360.0 / 256.0)
-
 	/*
 		GPS_TYPE_NMEA     = 0x01
 		GPS_TYPE_UBX      = 0x02
@@ -169,9 +168,6 @@ var product_name_map = map[int]string{
 	413: "Text",    //"Generic Textual Data Product APDU Payload Format Type 2";
 }
 
-// CRC16 table generated to use to work with GDL90 messages.
-var Crc16Table [256]uint16
-
 // Current AHRS, pressure altitude, etc.
 var mySituation SituationData
 
@@ -215,69 +211,8 @@ type ADSBTower struct {
 var ADSBTowers map[string]ADSBTower // Running list of all towers seen. (lat,lng) -> ADSBTower
 var ADSBTowerMutex *sync.Mutex
 
-// Construct the CRC table. Adapted from FAA ref above.
-func crcInit() {
-	var i uint16
-	var bitctr uint16
-	var crc uint16
-	for i = 0; i < 256; i++ {
-		crc = (i << 8)
-		for bitctr = 0; bitctr < 8; bitctr++ {
-			z := uint16(0)
-			if (crc & 0x8000) != 0 {
-				z = 0x1021
-			}
-			crc = (crc << 1) ^ z
-		}
-		Crc16Table[i] = crc
-	}
-}
-
-// Compute CRC. Adapted from FAA ref above.
-func crcCompute(data []byte) uint16 {
-	ret := uint16(0)
-	for i := 0; i < len(data); i++ {
-		ret = Crc16Table[ret>>8] ^ (ret << 8) ^ uint16(data[i])
-	}
-	return ret
-}
-
-func prepareMessage(data []byte) []byte {
-	// Compute CRC before modifying the message.
-	crc := crcCompute(data)
-	// Add the two CRC16 bytes before replacing control characters.
-	data = append(data, byte(crc&0xFF))
-	data = append(data, byte(crc>>8))
-
-	tmp := []byte{0x7E} // Flag start.
-
-	// Copy the message over, escaping 0x7E (Flag Byte) and 0x7D (Control-Escape).
-	for i := 0; i < len(data); i++ {
-		mv := data[i]
-		if (mv == 0x7E) || (mv == 0x7D) {
-			mv = mv ^ 0x20
-			tmp = append(tmp, 0x7D)
-		}
-		tmp = append(tmp, mv)
-	}
-
-	tmp = append(tmp, 0x7E) // Flag end.
-
-	return tmp
-}
-
-func makeLatLng(v float32) []byte {
-	ret := make([]byte, 3)
-
-	v = v / LON_LAT_RESOLUTION
-	wk := int32(v)
-
-	ret[0] = byte((wk & 0xFF0000) >> 16)
-	ret[1] = byte((wk & 0x00FF00) >> 8)
-	ret[2] = byte((wk & 0x0000FF))
-
-	return ret
-}
+// FIS-B products split across several uplinks. See parseInput().
+var fisbSegments *uatparse.SegmentReassembler
 
 func isDetectedOwnshipValid() bool {
 	return stratuxClock.Since(OwnshipTrafficInfo.Last_seen) < 10*time.Second
@@ -291,137 +226,73 @@ func makeOwnshipReport() bool {
 	}
 	curOwnship := OwnshipTrafficInfo
 
-	msg := make([]byte, 28)
 	// See p.16.
-	msg[0] = 0x0A // Message type "Ownship".
+	r := gdl90.OwnshipReport{}
 
-	// Retrieve ICAO code from settings
-	code, _ := hex.DecodeString(globalSettings.OwnshipModeS)
+	// Retrieve ICAO code from settings, or auto-detected code.
+	trafficMutex.Lock()
+	code, codeValid := getOwnshipCode()
+	trafficMutex.Unlock()
 
 	// Ownship Target Identify (see 3.5.1.2 of GDL-90 Specifications)
-	// First half of byte is 0 for Alert type of 'No Traffic Alert'
-	// Second half of byte is 0 for traffic type 'ADS-B with ICAO'
-	// Send 0x01 by default, unless ICAO is set, send 0x00
-	if (len(code) == 3 && code[0] != 0xF0 && code[0] != 0x00) {
-		msg[1] = 0x00 // ADS-B Out with ICAO
-		msg[2] = code[0] // Mode S address.
-		msg[3] = code[1] // Mode S address.
-		msg[4] = code[2] // Mode S address.
+	// Alert type of 'No Traffic Alert'.
+	// Traffic type 'ADS-B with ICAO' if ICAO is set, 'ADS-B with self-assigned code' otherwise.
+	if codeValid {
+		r.AddrType = 0x00 // ADS-B Out with ICAO
+		r.Address = code
 	} else {
-		msg[1] = 0x01 // ADS-B Out with self-assigned code
-		// Reserved dummy code.
-		msg[2] = 0xF0
-		msg[3] = 0x00
-		msg[4] = 0x00
+		r.AddrType = 0x01    // ADS-B Out with self-assigned code
+		r.Address = 0xF00000 // Reserved dummy code.
 	}
 
-	var tmp []byte
 	if selfOwnshipValid {
-		tmp = makeLatLng(curOwnship.Lat)
-		msg[5] = tmp[0] // Latitude.
-		msg[6] = tmp[1] // Latitude.
-		msg[7] = tmp[2] // Latitude.
-		tmp = makeLatLng(curOwnship.Lng)
-		msg[8] = tmp[0]  // Longitude.
-		msg[9] = tmp[1]  // Longitude.
-		msg[10] = tmp[2] // Longitude.
+		r.Lat = curOwnship.Lat
+		r.Lng = curOwnship.Lng
 	} else {
-		tmp = makeLatLng(mySituation.GPSLatitude)
-		msg[5] = tmp[0] // Latitude.
-		msg[6] = tmp[1] // Latitude.
-		msg[7] = tmp[2] // Latitude.
-		tmp = makeLatLng(mySituation.GPSLongitude)
-		msg[8] = tmp[0]  // Longitude.
-		msg[9] = tmp[1]  // Longitude.
-		msg[10] = tmp[2] // Longitude.
+		r.Lat = mySituation.GPSLatitude
+		r.Lng = mySituation.GPSLongitude
 	}
 
 	// This is **PRESSURE ALTITUDE**
-	alt := uint16(0xFFF) // 0xFFF "invalid altitude."
-	validAltf := false
-
-	var altf float64
-
 	if selfOwnshipValid {
-		altf = float64(curOwnship.Alt)
-		validAltf = true
+		r.Alt = curOwnship.Alt
+		r.AltValid = true
 	} else if isTempPressValid() {
-		altf = float64(mySituation.BaroPressureAltitude)
-		validAltf = true
+		r.Alt = int32(mySituation.BaroPressureAltitude)
+		r.AltValid = true
 	}
 
-	if validAltf {
-		altf = (altf + 1000) / 25
-		alt = uint16(altf) & 0xFFF // Should fit in 12 bits.
-	}
-
-	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
-	msg[12] = byte((alt & 0x00F) << 4)
 	if selfOwnshipValid || isGPSGroundTrackValid() {
-		msg[12] = msg[12] | 0x09 // "Airborne" + "True Track"
+		r.Airborne = true
+		r.TrackType = gdl90.TRACK_TYPE_TRUE_TRACK
 	}
 
-	msg[13] = byte(0x80 | (mySituation.GPSNACp & 0x0F)) //Set NIC = 8 and use NACp from gps.go.
+	r.NIC = 8 // Set NIC = 8 and use NACp from gps.go.
+	r.NACp = mySituation.GPSNACp
 
-	gdSpeed := uint16(0) // 1kt resolution.
+	// 1kt resolution.
+	r.SpeedValid = true
 	if selfOwnshipValid && curOwnship.Speed_valid {
-		gdSpeed = curOwnship.Speed
+		r.Speed = curOwnship.Speed
 	} else if isGPSGroundTrackValid() {
-		gdSpeed = uint16(mySituation.GPSGroundSpeed + 0.5)
+		r.Speed = uint16(mySituation.GPSGroundSpeed + 0.5)
 	}
 
-	// gdSpeed should fit in 12 bits.
-	msg[14] = byte((gdSpeed & 0xFF0) >> 4)
-	msg[15] = byte((gdSpeed & 0x00F) << 4)
-
-	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution.
-	//TODO: 0x800 = no information available.
-	// verticalVelocity should fit in 12 bits.
-	msg[15] = msg[15] | byte((verticalVelocity&0x0F00)>>8)
-	msg[16] = byte(verticalVelocity & 0xFF)
+	//TODO: Vertical velocity. Not sent - "no information available".
 
 	// Track is degrees true, set from GPS true course.
-	groundTrack := float32(0)
 	if selfOwnshipValid {
-		groundTrack = float32(curOwnship.Track)
+		r.Track = float32(curOwnship.Track)
 	} else if isGPSGroundTrackValid() {
-		groundTrack = mySituation.GPSTrueCourse
-	}
-
-	tempTrack := groundTrack + TRACK_RESOLUTION/2 // offset by half the 8-bit resolution to minimize binning error
-
-	for tempTrack > 360 {
-		tempTrack -= 360
+		r.Track = mySituation.GPSTrueCourse
 	}
-	for tempTrack < 0 {
-		tempTrack += 360
-	}
-
-	trk := uint8(tempTrack / TRACK_RESOLUTION) // Resolution is ~1.4 degrees.
 
-	//log.Printf("For groundTrack = %.2f°, tempTrack= %.2f, trk = %d (%f°)\n",groundTrack,tempTrack,trk,float32(trk)*TRACK_RESOLUTION)
-
-	msg[17] = byte(trk)
-
-	msg[18] = 0x01 // "Light (ICAO) < 15,500 lbs"
-
-	if selfOwnshipValid {
-		// Limit tail number to 7 characters.
-		tail := curOwnship.Tail
-		if len(tail) > 7 {
-			tail = tail[:7]
-		}
-		// Copy tail number into message.
-		for i := 0; i < len(tail); i++ {
-			msg[19+i] = tail[i]
-		}
-	}
+	r.Emitter = 0x01 // "Light (ICAO) < 15,500 lbs"
 
 	myReg := "Stratux" // Default callsign.
 	// Use icao2reg() results for ownship tail number, if available.
-	if len(code) == 3 {
-		uintIcao := uint32(code[0])<<16 | uint32(code[1])<<8 | uint32(code[2])
-		regFromIcao, regFromIcaoValid := icao2reg(uintIcao)
+	if codeValid {
+		regFromIcao, regFromIcaoValid := icao2reg(code)
 		if regFromIcaoValid {
 			// Valid "decoded" registration. Use this for the reg.
 			myReg = regFromIcao
@@ -432,13 +303,9 @@ func makeOwnshipReport() bool {
 	if len(myReg) > 8 {
 		myReg = myReg[:8]
 	}
+	r.Callsign = myReg
 
-	// Write the callsign.
-	for i := 0; i < len(myReg); i++ {
-		msg[19+i] = myReg[i]
-	}
-
-	sendGDL90(prepareMessage(msg), false)
+	sendGDL90(gdl90.Encode(r), false)
 	return true
 }
 
@@ -446,18 +313,13 @@ func makeOwnshipGeometricAltitudeReport() bool {
 	if !isGPSValid() {
 		return false
 	}
-	msg := make([]byte, 5)
 	// See p.28.
-	msg[0] = 0x0B                                // Message type "Ownship Geo Alt".
-	alt := int16(mySituation.GPSAltitudeMSL / 5) // GPS Altitude, encoded to 16-bit int using 5-foot resolution
-	msg[1] = byte(alt >> 8)                      // Altitude.
-	msg[2] = byte(alt & 0x00FF)                  // Altitude.
-
-	//TODO: "Figure of Merit". 0x7FFF "Not available".
-	msg[3] = 0x00
-	msg[4] = 0x0A
+	r := gdl90.OwnshipGeometricAltitude{
+		Alt:  int32(mySituation.GPSAltitudeMSL), // GPS Altitude, encoded to 16-bit int using 5-foot resolution
+		VFOM: 10,                                //TODO: "Figure of Merit". 0x7FFF "Not available".
+	}
 
-	sendGDL90(prepareMessage(msg), false)
+	sendGDL90(gdl90.Encode(r), false)
 	return true
 }
 
@@ -610,18 +472,18 @@ func makeStratuxStatus() []byte {
 
 	// List of ADS-B towers (lat, lng).
 	for _, tower := range ADSBTowers {
-		tmp := makeLatLng(float32(tower.Lat))
+		tmp := gdl90.EncodeLatLng(float32(tower.Lat))
 		msg = append(msg, tmp[0]) // Latitude.
 		msg = append(msg, tmp[1]) // Latitude.
 		msg = append(msg, tmp[2]) // Latitude.
 
-		tmp = makeLatLng(float32(tower.Lng))
+		tmp = gdl90.EncodeLatLng(float32(tower.Lng))
 		msg = append(msg, tmp[0]) // Longitude.
 		msg = append(msg, tmp[1]) // Longitude.
 		msg = append(msg, tmp[2]) // Longitude.
 	}
 	ADSBTowerMutex.Unlock()
-	return prepareMessage(msg)
+	return gdl90.Frame(msg)
 }
 
 /*
@@ -648,7 +510,7 @@ func makeStratuxHeartbeat() []byte {
 	protocolVers := int8(1)
 	msg[1] = msg[1] | byte(protocolVers<<2)
 
-	return prepareMessage(msg)
+	return gdl90.Frame(msg)
 }
 
 /*
@@ -681,53 +543,48 @@ func makeFFIDMessage() []byte {
 
 	msg[38] = 0x01 // Capabilities mask. MSL altitude for Ownship Geometric report.
 
-	return prepareMessage(msg)
+	return gdl90.Frame(msg)
 }
 
 func makeHeartbeat() []byte {
-	msg := make([]byte, 7)
 	// See p.10.
-	msg[0] = 0x00 // Message type "Heartbeat".
-	msg[1] = 0x01 // "UAT Initialized".
-	if isGPSValid() {
-		msg[1] = msg[1] | 0x80
+	hb := gdl90.Heartbeat{
+		GPSPositionValid: isGPSValid(),
+		UATInitialized:   true,
+		AddrTalkback:     true, //FIXME: Addr talkback.
+		UTCOK:            true,
 	}
-	msg[1] = msg[1] | 0x10 //FIXME: Addr talkback.
 
 	// "Maintenance Req'd". Add flag if there are any current critical system errors.
-	if len(globalStatus.Errors) > 0 {
-		msg[1] = msg[1] | 0x40
-	}
+	hb.MaintenanceRequired = len(globalStatus.Errors) > 0
 
 	nowUTC := time.Now().UTC()
 	// Seconds since 0000Z.
 	midnightUTC := time.Date(nowUTC.Year(), nowUTC.Month(), nowUTC.Day(), 0, 0, 0, 0, time.UTC)
-	secondsSinceMidnightUTC := uint32(nowUTC.Sub(midnightUTC).Seconds())
-
-	msg[2] = byte(((secondsSinceMidnightUTC >> 16) << 7) | 0x1) // UTC OK.
-	msg[3] = byte((secondsSinceMidnightUTC & 0xFF))
-	msg[4] = byte((secondsSinceMidnightUTC & 0xFFFF) >> 8)
+	hb.Timestamp = uint32(nowUTC.Sub(midnightUTC).Seconds())
 
 	// TODO. Number of uplink messages. See p.12.
-	// msg[5]
-	// msg[6]
 
-	return prepareMessage(msg)
+	return gdl90.Encode(hb)
 }
 
 func relayMessage(msgtype uint16, msg []byte) {
-	ret := make([]byte, len(msg)+4)
 	// See p.15.
-	ret[0] = byte(msgtype) // Uplink message ID.
-	ret[1] = 0x00          //TODO: Time.
-	ret[2] = 0x00          //TODO: Time.
-	ret[3] = 0x00          //TODO: Time.
-
-	for i := 0; i < len(msg); i++ {
-		ret[i+4] = msg[i]
+	var m gdl90.Message
+	switch msgtype {
+	case MSGTYPE_UPLINK:
+		m = gdl90.UplinkData{Payload: msg} //TODO: Time.
+	default:
+		m = gdl90.PassThroughReport{Long: msgtype == MSGTYPE_LONG_REPORT, Payload: msg} //TODO: Time.
 	}
 
-	sendGDL90(prepareMessage(ret), true)
+	// Uplinks are keyed by product/location, so that newer copies replace older ones in client queues.
+	// The keys are decoded only if the uplink is queued. See networkMessage.setQueueKeys().
+	nm := networkMessage{msg: gdl90.Encode(m), msgType: NETWORK_GDL90_STANDARD, queueable: true, ts: stratuxClock.Time, priority: queuePriorityDefault}
+	if msgtype == MSGTYPE_UPLINK {
+		nm.uplink = msg
+	}
+	messageQueue <- nm
 }
 
 func blinkStatusLED() {
@@ -906,6 +763,9 @@ func updateStatus() {
 	globalStatus.Uptime = int64(stratuxClock.Milliseconds)
 	globalStatus.UptimeClock = stratuxClock.Time
 
+	globalStatus.MQTT_messages_total = atomic.LoadUint64(&mqttMessagesTotal)
+	globalStatus.MQTT_dropped_total = atomic.LoadUint64(&mqttDroppedTotal)
+
 	usage = du.NewDiskUsage("/")
 	globalStatus.DiskBytesFree = usage.Free()
 	fileInfo, err := logFileHandle.Stat()
@@ -929,6 +789,8 @@ type WeatherMessage struct {
 	Time              string
 	Data              string
 	LocaltimeReceived time.Time
+	METAR             *METAR `json:",omitempty"` // Decoded METAR or SPECI.
+	TAF               *TAF   `json:",omitempty"` // Decoded TAF or amended TAF.
 }
 
 // Send update to connected websockets.
@@ -957,9 +819,16 @@ func registerADSBTextMessageReceived(msg string, uatMsg *uatparse.UATMsg) {
 	wm.Time = x[2]
 	wm.Data = strings.Join(x[3:], " ")
 	wm.LocaltimeReceived = stratuxClock.Time
+	switch wm.Type {
+	case "METAR", "SPECI":
+		wm.METAR = parseMETAR(msg)
+	case "TAF", "TAF.AMD":
+		wm.TAF = parseTAF(msg)
+	}
 
 	// Send to weatherUpdate channel for any connected clients.
 	weatherUpdate.SendJSON(wm)
+	mqttPublishWeather(wm)
 }
 
 func UpdateUATStats(ProductID uint32) {
@@ -968,8 +837,14 @@ func UpdateUATStats(ProductID uint32) {
 		globalStatus.UAT_METAR_total++
 	case 1, 21:
 		globalStatus.UAT_TAF_total++
-	case 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 81, 82, 83:
+	case 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64:
 		globalStatus.UAT_NEXRAD_total++
+	case 81, 82, 83:
+		globalStatus.UAT_TOPS_total++
+	case 101, 102, 151:
+		globalStatus.UAT_LIGHTNING_total++
+	case 401, 402, 403, 404, 405, 411, 412:
+		globalStatus.UAT_GENERIC_total++
 	// AIRMET and SIGMETS
 	case 2, 3, 4, 6, 11, 12, 22, 23, 24, 26, 254:
 		globalStatus.UAT_SIGMET_total++
@@ -1066,13 +941,25 @@ func parseInput(buf string) ([]byte, uint16) {
 		uatMsg, err := uatparse.New(buf)
 		if err == nil {
 			uatMsg.DecodeUplink()
+			// Products whose last segment is in this uplink are added to uatMsg.Frames.
+			fisbSegments.Reassemble(uatMsg)
+			globalStatus.UAT_segmented_products_total, globalStatus.UAT_segmented_products_expired = fisbSegments.Counts()
 			towerid := fmt.Sprintf("(%f,%f)", uatMsg.Lat, uatMsg.Lon)
 			thisMsg.ADSBTowerID = towerid
 			// Get all of the "product ids".
 			for _, f := range uatMsg.Frames {
+				weatherRawUpdate.SendJSON(f)
+				if f.IsSegment() {
+					continue // Counted once the product is reassembled.
+				}
 				thisMsg.Products = append(thisMsg.Products, f.Product_id)
 				UpdateUATStats(f.Product_id)
-				weatherRawUpdate.SendJSON(f)
+				if len(f.Overlays) > 0 {
+					registerWeatherGraphics(f)
+				}
+				if len(f.NEXRAD) > 0 {
+					registerNEXRADBlocks(f.NEXRAD)
+				}
 			}
 			// Get all of the text reports.
 			textReports, _ := uatMsg.GetTextReports()
@@ -1103,34 +990,55 @@ func getProductNameFromId(product_id int) string {
 }
 
 type settings struct {
-	DarkMode             bool
-	UAT_Enabled          bool
-	ES_Enabled           bool
-	Ping_Enabled         bool
-	GPS_Enabled          bool
-	BMP_Sensor_Enabled   bool
-	IMU_Sensor_Enabled   bool
-	NetworkOutputs       []networkConnection
-	SerialOutputs        map[string]serialConnection
-	DisplayTrafficSource bool
-	DEBUG                bool
-	ReplayLog            bool
-	AHRSLog              bool
-	IMUMapping           [2]int     // Map from aircraft axis to sensor axis: accelerometer
-	SensorQuaternion     [4]float64 // Quaternion mapping from sensor frame to aircraft frame
-	C, D                 [3]float64 // IMU Accel, Gyro zero bias
-	PPM                  int
-	OwnshipModeS         string
-	WatchList            string
-	DeveloperMode        bool
-	GLimits              string
-	StaticIps            []string
-	WiFiSSID             string
-	WiFiChannel          int
-	WiFiSecurityEnabled  bool
-	WiFiPassphrase       string
-	WiFiSmartEnabled     bool // "Smart WiFi" - disables the default gateway for iOS.
-	NoSleep              bool
+	DarkMode              bool
+	UAT_Enabled           bool
+	ES_Enabled            bool
+	Ping_Enabled          bool
+	GPS_Enabled           bool
+	BMP_Sensor_Enabled    bool
+	IMU_Sensor_Enabled    bool
+	NetworkOutputs        []networkConnection
+	TCPOutputs            []networkConnection // TCP ports to listen on. Port, Capability, and TrafficFilter are used.
+	SerialOutputs         map[string]serialConnection
+	DisplayTrafficSource  bool
+	DEBUG                 bool
+	ReplayLog             bool
+	AHRSLog               bool
+	IMUMapping            [2]int     // Map from aircraft axis to sensor axis: accelerometer
+	SensorQuaternion      [4]float64 // Quaternion mapping from sensor frame to aircraft frame
+	C, D                  [3]float64 // IMU Accel, Gyro zero bias
+	PPM                   int
+	OwnshipModeS          string
+	WatchList             string
+	DeveloperMode         bool
+	GLimits               string
+	StaticIps             []string
+	LeaseSources          []string // Where to find connected clients for unicast outputs: "isc", "dnsmasq", "arp", "static". See leases.go.
+	WiFiSSID              string
+	WiFiChannel           int
+	WiFiSecurityEnabled   bool
+	WiFiPassphrase        string
+	WiFiSmartEnabled      bool // "Smart WiFi" - disables the default gateway for iOS.
+	NoSleep               bool
+	TrafficMaxCoastTime   int     // Seconds to keep sending a stale target with its position extrapolated from last track and speed. 0 disables coasting.
+	TrafficAlertTime      int     // Look-ahead time for traffic alerts, seconds. Alert if the CPA thresholds below are violated within this time.
+	TrafficAlertDistance  float64 // Horizontal distance at closest point of approach below which traffic is alerted, nm.
+	TrafficAlertAltitude  int     // Vertical separation at closest point of approach (or now, for proximity alerts) below which traffic is alerted, feet.
+	TrafficAlertProximity float64 // Alert traffic inside this horizontal distance regardless of closure, nm.
+	OwnshipAutoDetect     bool    // Detect the ownship ICAO address by correlating traffic with GPS/baro data when OwnshipModeS is not set.
+	OwnshipAutoPersist    bool    // Save an auto-detected ownship ICAO address to OwnshipModeS.
+	SBSOutputEnabled      bool    // Serve SBS-1 (BaseStation) format traffic over TCP.
+	SBSOutputPort         int     // TCP port for SBS output. dump1090 already serves 1090ES-only SBS on 30003.
+	GDL90InputUDPPort     int     // UDP port to listen on for GDL90 from another receiver. 0 disables.
+	GDL90InputDevice      string  // Serial device to read GDL90 from another receiver, e.g. "/dev/ttyUSB1". Empty disables.
+	GDL90InputBaud        int     // Baud rate of GDL90InputDevice.
+	MQTTEnabled           bool    // Publish traffic, situation, status and weather to an MQTT broker. See mqtt.go.
+	MQTTBroker            string  // e.g. "tcp://192.168.10.10:1883", "ssl://broker.example.com:8883".
+	MQTTTopicPrefix       string
+	MQTTQoS               byte // 0, 1 or 2.
+	MQTTClientID          string
+	MQTTUsername          string
+	MQTTPassword          string
 }
 
 type status struct {
@@ -1146,6 +1054,12 @@ type status struct {
 	ES_messages_max                            uint
 	UAT_traffic_targets_tracking               uint16
 	ES_traffic_targets_tracking                uint16
+	GDL90Input_traffic_targets_tracking        uint16
+	GDL90Input_messages_total                  uint64
+	GDL90Input_errors_total                    uint64
+	MQTT_connected                             bool
+	MQTT_messages_total                        uint64
+	MQTT_dropped_total                         uint64 // Messages not published because the broker wasn't connected or the queue was full.
 	Ping_connected                             bool
 	UATRadio_connected                         bool
 	GPS_satellites_locked                      uint16
@@ -1168,19 +1082,30 @@ type status struct {
 	NetworkDataMessagesSentNonqueueableLastSec uint64
 	NetworkDataBytesSentLastSec                uint64
 	NetworkDataBytesSentNonqueueableLastSec    uint64
+	NetworkBroadcastMessagesSent               uint64
+	NetworkBroadcastBytesSent                  uint64
+	NetworkMulticastMessagesSent               uint64
+	NetworkMulticastBytesSent                  uint64
 	UAT_METAR_total                            uint32
 	UAT_TAF_total                              uint32
 	UAT_NEXRAD_total                           uint32
 	UAT_SIGMET_total                           uint32
 	UAT_PIREP_total                            uint32
 	UAT_NOTAM_total                            uint32
+	UAT_TOPS_total                             uint32 // Echo tops.
+	UAT_LIGHTNING_total                        uint32
+	UAT_GENERIC_total                          uint32 // Generic raster, vector, symbol and text products, other than 413 text.
 	UAT_OTHER_total                            uint32
+	UAT_segmented_products_total               uint64 // FIS-B products reassembled from several APDUs.
+	UAT_segmented_products_expired             uint64 // Segmented products discarded because not all segments were received.
 	Errors                                     []string
 	Logfile_Size                               int64
 	AHRS_LogFiles_Size                         int64
 	BMPConnected                               bool
 	IMUConnected                               bool
-	NightMode                                  bool // For turning off LEDs.
+	NightMode                                  bool               // For turning off LEDs.
+	OwnshipDetected                            string             // Auto-detected ownship ICAO address, hex. Empty if not detected.
+	OwnshipCandidates                          []OwnshipCandidate // Best ownship detection candidates.
 }
 
 var globalSettings settings
@@ -1206,7 +1131,25 @@ func defaultSettings() {
 	globalSettings.OwnshipModeS = "F00000"
 	globalSettings.DeveloperMode = false
 	globalSettings.StaticIps = make([]string, 0)
+	globalSettings.LeaseSources = []string{"isc", "static"}
 	globalSettings.NoSleep = false
+	globalSettings.TrafficMaxCoastTime = 15
+	globalSettings.TrafficAlertTime = 30
+	globalSettings.TrafficAlertDistance = 0.5
+	globalSettings.TrafficAlertAltitude = 850
+	globalSettings.TrafficAlertProximity = 1.0
+	globalSettings.OwnshipAutoDetect = false
+	globalSettings.OwnshipAutoPersist = false
+	globalSettings.SBSOutputEnabled = false
+	globalSettings.SBSOutputPort = 30103
+	globalSettings.GDL90InputUDPPort = 0
+	globalSettings.GDL90InputDevice = ""
+	globalSettings.GDL90InputBaud = 38400 // GDL90 spec, p.3.
+	globalSettings.MQTTEnabled = false
+	globalSettings.MQTTBroker = "tcp://localhost:1883"
+	globalSettings.MQTTTopicPrefix = "stratux"
+	globalSettings.MQTTQoS = 0
+	globalSettings.MQTTClientID = "stratux"
 }
 
 func readSettings() {
@@ -1217,20 +1160,43 @@ func readSettings() {
 		return
 	}
 	defer fd.Close()
-	buf := make([]byte, 1024)
-	count, err := fd.Read(buf)
+	buf, err := ioutil.ReadAll(fd)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
 		return
 	}
 	var newSettings settings
-	err = json.Unmarshal(buf[0:count], &newSettings)
+	err = json.Unmarshal(buf, &newSettings)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
 		return
 	}
+	// Settings added since the file was written come up as zero values. Fill in the ones where zero
+	// isn't usable, and leave the rest as they were.
+	defaultSettings()
+	defaults := globalSettings
+	if newSettings.TrafficAlertTime == 0 { // Written before CPA traffic alerting.
+		newSettings.TrafficAlertTime = defaults.TrafficAlertTime
+		newSettings.TrafficAlertDistance = defaults.TrafficAlertDistance
+		newSettings.TrafficAlertAltitude = defaults.TrafficAlertAltitude
+		newSettings.TrafficAlertProximity = defaults.TrafficAlertProximity
+	}
+	if newSettings.SBSOutputPort == 0 {
+		newSettings.SBSOutputPort = defaults.SBSOutputPort
+	}
+	if newSettings.GDL90InputBaud == 0 {
+		newSettings.GDL90InputBaud = defaults.GDL90InputBaud
+	}
+	if newSettings.LeaseSources == nil { // An empty list is deliberate.
+		newSettings.LeaseSources = defaults.LeaseSources
+	}
+	if newSettings.MQTTBroker == "" { // Written before MQTT output.
+		newSettings.MQTTBroker = defaults.MQTTBroker
+		newSettings.MQTTTopicPrefix = defaults.MQTTTopicPrefix
+		newSettings.MQTTClientID = defaults.MQTTClientID
+	}
 	globalSettings = newSettings
 	log.Printf("read in settings.\n")
 	readWiFiUserSettings()
@@ -1627,13 +1593,14 @@ func main() {
 
 	ADSBTowers = make(map[string]ADSBTower)
 	ADSBTowerMutex = &sync.Mutex{}
+	fisbSegments = uatparse.NewSegmentReassembler(uatparse.DEFAULT_SEGMENT_TIMEOUT)
+	initWeatherGraphics()
+	initNEXRAD()
 	MsgLog = make([]msg, 0)
 
 	// Start the management interface.
 	go managementInterface()
 
-	crcInit() // Initialize CRC16 table.
-
 	sdrInit()
 	pingInit()
 	initTraffic()
@@ -1661,6 +1628,12 @@ func main() {
 	// Start the GPS external sensor monitoring.
 	initGPS()
 
+	// Start the SBS traffic output server. It listens only when enabled in settings.
+	initSBSOutput()
+	initGDL90Input()
+	initMQTT()
+	initMetrics()
+
 	// Start the heartbeat message loop in the background, once per second.
 	go heartBeatSender()
 
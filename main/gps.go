@@ -24,6 +24,8 @@ import (
 
 	"os"
 	"os/exec"
+
+	"../gdl90"
 )
 
 const (
@@ -1905,7 +1907,7 @@ func makeFFAHRSMessage() {
 	msg[10] = byte((tas >> 8) & 0xFF)
 	msg[11] = byte(tas & 0xFF)
 
-	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, false)
+	sendMsg(gdl90.Frame(msg), NETWORK_AHRS_GDL90, false)
 }
 
 /*
@@ -2003,7 +2005,7 @@ func makeAHRSGDL90Report() {
 	msg[22] = 0x7F
 	msg[23] = 0xFF
 
-	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, false)
+	sendMsg(gdl90.Frame(msg), NETWORK_AHRS_GDL90, false)
 }
 
 func gpsAttitudeSender() {
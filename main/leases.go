@@ -0,0 +1,246 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	leases.go: Sources of connected client IPs for unicast network outputs - ISC dhcpd and dnsmasq lease
+	 files, the kernel ARP/neighbor table, and static IPs. Selected with settings.LeaseSources.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dhcp_lease_file    = "/var/lib/dhcp/dhcpd.leases"
+	dhcp_lease_dir     = "/var/lib/dhcp"
+	dnsmasq_lease_file = "/var/lib/misc/dnsmasq.leases"
+	arp_table_file     = "/proc/net/arp"
+	extra_hosts_file   = "/etc/stratux-static-hosts.conf"
+)
+
+// A leaseSource returns the IPs of connected clients, mapped to their hostnames ("" if unknown).
+type leaseSource interface {
+	Leases() (map[string]string, error)
+}
+
+// Lease source names for settings.LeaseSources. A source may be followed by ':' and an argument,
+// e.g. "dnsmasq:/tmp/dnsmasq.leases" for a lease file in a different location, or "arp:wlan0" to
+// only use neighbors on one interface.
+var leaseSourceTypes = map[string]func(arg string) leaseSource{
+	"isc": func(arg string) leaseSource {
+		if len(arg) == 0 {
+			arg = dhcp_lease_file
+		}
+		return &iscLeaseSource{file: arg}
+	},
+	"dnsmasq": func(arg string) leaseSource {
+		if len(arg) == 0 {
+			arg = dnsmasq_lease_file
+		}
+		return dnsmasqLeaseSource{file: arg}
+	},
+	"arp":    func(arg string) leaseSource { return arpLeaseSource{iface: arg} },
+	"static": func(arg string) leaseSource { return staticLeaseSource{} },
+}
+
+// Sources created from settings.LeaseSources, by name. Kept between calls to getDHCPLeases() for the
+// ISC lease directory write test.
+var leaseSources map[string]leaseSource
+
+// newLeaseSource creates a lease source from its name in settings.LeaseSources.
+func newLeaseSource(name string) (leaseSource, error) {
+	x := strings.SplitN(name, ":", 2)
+	newSource, ok := leaseSourceTypes[x[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown lease source '%s'", x[0])
+	}
+	arg := ""
+	if len(x) > 1 {
+		arg = x[1]
+	}
+	return newSource(arg), nil
+}
+
+// ISC dhcpd "dhcpd.leases" file.
+type iscLeaseSource struct {
+	file          string
+	lastWriteTest time.Time // Last time fsWriteTest() was run on the DHCP lease directory.
+}
+
+func (s *iscLeaseSource) Leases() (map[string]string, error) {
+	// Do a write test. Even if we are able to read the file, it may be out of date because there's a fs write issue.
+	// Only perform the test once every 5 minutes to minimize writes.
+	if s.file == dhcp_lease_file && stratuxClock.Since(s.lastWriteTest) >= 5*time.Minute {
+		err := fsWriteTest(dhcp_lease_dir)
+		if err != nil {
+			addSingleSystemErrorf("fs-write", "Write error on '%s', your EFB may have issues receiving weather and traffic.", dhcp_lease_dir)
+		}
+		s.lastWriteTest = stratuxClock.Time
+	}
+	dat, err := ioutil.ReadFile(s.file)
+	ret := make(map[string]string)
+	if err != nil {
+		return ret, err
+	}
+	lines := strings.Split(string(dat), "\n")
+	open_block := false
+	block_ip := ""
+	for _, line := range lines {
+		spaced := strings.Split(line, " ")
+		if len(spaced) > 2 && spaced[0] == "lease" {
+			open_block = true
+			block_ip = spaced[1]
+		} else if open_block && len(spaced) >= 4 && spaced[2] == "client-hostname" {
+			hostname := strings.TrimRight(strings.TrimLeft(strings.Join(spaced[3:], " "), "\""), "\";")
+			ret[block_ip] = hostname
+			open_block = false
+		} else if open_block && strings.HasPrefix(spaced[0], "}") { // No hostname.
+			open_block = false
+			ret[block_ip] = ""
+		}
+	}
+	return ret, nil
+}
+
+// dnsmasq lease file. One lease per line: "<expiry time> <MAC> <IP> <hostname or *> <client ID or *>".
+type dnsmasqLeaseSource struct {
+	file string
+}
+
+func (s dnsmasqLeaseSource) Leases() (map[string]string, error) {
+	dat, err := ioutil.ReadFile(s.file)
+	ret := make(map[string]string)
+	if err != nil {
+		return ret, err
+	}
+	now := time.Now().Unix()
+	for _, line := range strings.Split(string(dat), "\n") {
+		x := strings.Fields(line)
+		if len(x) < 4 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(x[0], 10, 64)
+		if err != nil || (expiry != 0 && expiry < now) { // Zero for infinite leases.
+			continue
+		}
+		hostname := x[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		ret[x[2]] = hostname
+	}
+	return ret, nil
+}
+
+// Kernel ARP/neighbor table - clients that have talked to us recently, however they got their IP
+// (systemd-networkd's DHCP server, static configuration on the client, ...).
+type arpLeaseSource struct {
+	iface string // Only neighbors on this interface, if set.
+}
+
+func (s arpLeaseSource) Leases() (map[string]string, error) {
+	dat, err := ioutil.ReadFile(arp_table_file)
+	ret := make(map[string]string)
+	if err != nil {
+		return ret, err
+	}
+	// "IP address  HW type  Flags  HW address  Mask  Device", after a header line.
+	for _, line := range strings.Split(string(dat), "\n")[1:] {
+		x := strings.Fields(line)
+		if len(x) < 6 {
+			continue
+		}
+		flags, err := strconv.ParseUint(x[2], 0, 32)
+		if err != nil || (flags&0x02) == 0 { // ATF_COM - completed entry.
+			continue
+		}
+		if len(s.iface) > 0 && x[5] != s.iface {
+			continue
+		}
+		ret[x[0]] = ""
+	}
+	return ret, nil
+}
+
+// IPs set through the settings page (settings.StaticIps) and /etc/stratux-static-hosts.conf.
+type staticLeaseSource struct{}
+
+func (s staticLeaseSource) Leases() (map[string]string, error) {
+	ret := make(map[string]string)
+
+	// Add IP's set through the settings page
+	if globalSettings.StaticIps != nil {
+		for _, ip := range globalSettings.StaticIps {
+			ret[ip] = ""
+		}
+	}
+
+	// Added the ability to have static IP hosts stored in /etc/stratux-static-hosts.conf
+
+	dat2, err := ioutil.ReadFile(extra_hosts_file)
+	if err != nil {
+		return ret, nil
+	}
+
+	iplines := strings.Split(string(dat2), "\n")
+	block_ip2 := ""
+	for _, ipline := range iplines {
+		spacedip := strings.Split(ipline, " ")
+		if len(spacedip) == 2 {
+			// The ip is in block_ip2
+			block_ip2 = spacedip[0]
+			// the hostname is here
+			ret[block_ip2] = spacedip[1]
+		}
+	}
+
+	return ret, nil
+}
+
+// Get the connected client IPs/hostnames from all of the sources in settings.LeaseSources. Sources
+// that can't be read are reported as system errors and the rest are still used. Returns an error
+// only if none of the sources can be read, so that clients aren't all dropped because of a
+// transient read error.
+// ***WARNING***: netMutex must be locked before calling this function.
+func getDHCPLeases() (map[string]string, error) {
+	if leaseSources == nil {
+		leaseSources = make(map[string]leaseSource)
+	}
+	ret := make(map[string]string)
+	numFailed := 0
+	for _, name := range globalSettings.LeaseSources {
+		source, ok := leaseSources[name]
+		if !ok {
+			var err error
+			if source, err = newLeaseSource(name); err != nil {
+				addSingleSystemErrorf("lease-source-"+name, "Invalid lease source: %s", err.Error())
+				numFailed++
+				continue
+			}
+			leaseSources[name] = source
+		}
+		leases, err := source.Leases()
+		if err != nil {
+			addSingleSystemErrorf("lease-source-"+name, "Can't read lease source %s: %s", name, err.Error())
+			numFailed++
+			continue
+		}
+		for ip, hostname := range leases {
+			if h, ok := ret[ip]; !ok || len(h) == 0 {
+				ret[ip] = hostname
+			}
+		}
+	}
+	if numFailed > 0 && numFailed == len(globalSettings.LeaseSources) {
+		return ret, fmt.Errorf("none of the lease sources %v can be read", globalSettings.LeaseSources)
+	}
+	return ret, nil
+}
@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/websocket"
 	"io"
 	"io/ioutil"
@@ -115,6 +116,34 @@ func handleJsonIo(conn *websocket.Conn) {
 	}
 }
 
+// Traffic alert events channel.
+var alertUpdate *uibroadcaster
+
+// The /alerts websocket starts off by sending the recent alert events, then sends new alerts as they are raised.
+func handleAlertsWS(conn *websocket.Conn) {
+	alertsMutex.Lock()
+	for _, a := range recentAlerts {
+		alertJSON, _ := json.Marshal(&a)
+		conn.Write(alertJSON)
+	}
+	// Subscribe the socket to receive updates.
+	alertUpdate.AddSocket(conn)
+	alertsMutex.Unlock()
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
+	for {
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if buf[0] != 0 { // Dummy.
+			continue
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
 // Works just as weather updates do.
 
 func handleTrafficWS(conn *websocket.Conn) {
@@ -312,22 +341,77 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						}
 					case "PPM":
 						globalSettings.PPM = int(val.(float64))
+					case "TrafficMaxCoastTime":
+						globalSettings.TrafficMaxCoastTime = int(val.(float64))
+					case "TrafficAlertTime":
+						globalSettings.TrafficAlertTime = int(val.(float64))
+					case "TrafficAlertDistance":
+						globalSettings.TrafficAlertDistance = val.(float64)
+					case "TrafficAlertAltitude":
+						globalSettings.TrafficAlertAltitude = int(val.(float64))
+					case "TrafficAlertProximity":
+						globalSettings.TrafficAlertProximity = val.(float64)
 					case "Baud":
-						if serialOut, ok := globalSettings.SerialOutputs["/dev/serialout0"]; ok { //FIXME: Only one device for now.
+						serialOutMutex.Lock()
+						if serialOut, ok := globalSettings.SerialOutputs["/dev/serialout0"]; ok {
 							newBaud := int(val.(float64))
-							if newBaud == serialOut.Baud { // Same baud rate. No change.
-								continue
+							if newBaud != serialOut.Baud {
+								// serialOutWatcher() reopens the port with the new baud rate.
+								log.Printf("changing /dev/serialout0 baud rate from %d to %d.\n", serialOut.Baud, newBaud)
+								serialOut.Baud = newBaud
+								globalSettings.SerialOutputs["/dev/serialout0"] = serialOut
 							}
-							log.Printf("changing /dev/serialout0 baud rate from %d to %d.\n", serialOut.Baud, newBaud)
-							serialOut.Baud = newBaud
-							// Close the port if it is open.
-							if serialOut.serialPort != nil {
-								log.Printf("closing /dev/serialout0 for baud rate change.\n")
-								serialOut.serialPort.Close()
-								serialOut.serialPort = nil
+						}
+						serialOutMutex.Unlock()
+					case "TrafficFilter":
+						// Expecting an object with the NetworkOutputs port to change and the filter values.
+						var f struct {
+							Port uint32
+							trafficFilter
+						}
+						b, _ := json.Marshal(val)
+						if err := json.Unmarshal(b, &f); err != nil {
+							log.Printf("handleSettingsSetRequest:TrafficFilter: %s\n", err.Error())
+							continue
+						}
+						if !setTrafficFilter(f.Port, f.trafficFilter) {
+							log.Printf("handleSettingsSetRequest:TrafficFilter: no network output on port %d\n", f.Port)
+						}
+					case "NetworkOutputs", "TCPOutputs":
+						// Expecting an array of outputs, e.g. [{"Port":4000,"Capability":5}].
+						var outputs []networkConnection
+						b, _ := json.Marshal(val)
+						if err := json.Unmarshal(b, &outputs); err != nil {
+							log.Printf("handleSettingsSetRequest:%s: %s\n", key, err.Error())
+							continue
+						}
+						netMutex.Lock()
+						if key == "NetworkOutputs" {
+							globalSettings.NetworkOutputs = outputs
+						} else {
+							globalSettings.TCPOutputs = outputs
+						}
+						netMutex.Unlock()
+						go refreshConnectedClients()
+					case "SerialOutputs":
+						// Expecting an object keyed by device, e.g. {"/dev/serialout0":{"Baud":115200,"Protocol":1}}.
+						// Replaces all serial outputs. serialOutWatcher() opens, closes, and reopens ports to match.
+						var outputs map[string]serialConnection
+						b, _ := json.Marshal(val)
+						if err := json.Unmarshal(b, &outputs); err != nil {
+							log.Printf("handleSettingsSetRequest:SerialOutputs: %s\n", err.Error())
+							continue
+						}
+						for dev, serialOut := range outputs {
+							serialOut.DeviceString = dev
+							if serialOut.Baud <= 0 {
+								serialOut.Baud = 38400
 							}
-							globalSettings.SerialOutputs["/dev/serialout0"] = serialOut
+							outputs[dev] = serialOut
 						}
+						serialOutMutex.Lock()
+						globalSettings.SerialOutputs = outputs
+						serialOutMutex.Unlock()
 					case "WatchList":
 						globalSettings.WatchList = val.(string)
 					case "GLimits":
@@ -348,6 +432,34 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 							continue
 						}
 						globalSettings.OwnshipModeS = fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2])
+					case "OwnshipAutoDetect":
+						globalSettings.OwnshipAutoDetect = val.(bool)
+					case "OwnshipAutoPersist":
+						globalSettings.OwnshipAutoPersist = val.(bool)
+					case "SBSOutputEnabled":
+						globalSettings.SBSOutputEnabled = val.(bool)
+					case "SBSOutputPort":
+						globalSettings.SBSOutputPort = int(val.(float64))
+					case "GDL90InputUDPPort":
+						globalSettings.GDL90InputUDPPort = int(val.(float64))
+					case "GDL90InputDevice":
+						globalSettings.GDL90InputDevice = val.(string)
+					case "GDL90InputBaud":
+						globalSettings.GDL90InputBaud = int(val.(float64))
+					case "MQTTEnabled":
+						globalSettings.MQTTEnabled = val.(bool)
+					case "MQTTBroker":
+						globalSettings.MQTTBroker = val.(string)
+					case "MQTTTopicPrefix":
+						globalSettings.MQTTTopicPrefix = val.(string)
+					case "MQTTQoS":
+						globalSettings.MQTTQoS = byte(val.(float64))
+					case "MQTTClientID":
+						globalSettings.MQTTClientID = val.(string)
+					case "MQTTUsername":
+						globalSettings.MQTTUsername = val.(string)
+					case "MQTTPassword":
+						globalSettings.MQTTPassword = val.(string)
 					case "StaticIps":
 						ipsStr := val.(string)
 						ips := strings.Split(ipsStr, " ")
@@ -368,6 +480,28 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 							continue
 						}
 						globalSettings.StaticIps = ips
+					case "LeaseSources":
+						// Expecting an array of source names, e.g. ["dnsmasq", "arp:wlan0", "static"].
+						var sources []string
+						b, _ := json.Marshal(val)
+						if err := json.Unmarshal(b, &sources); err != nil {
+							log.Printf("handleSettingsSetRequest:LeaseSources: %s\n", err.Error())
+							continue
+						}
+						valid := true
+						for _, name := range sources {
+							if _, err := newLeaseSource(name); err != nil {
+								log.Printf("handleSettingsSetRequest:LeaseSources: %s\n", err.Error())
+								valid = false
+							}
+						}
+						if !valid {
+							continue
+						}
+						netMutex.Lock()
+						globalSettings.LeaseSources = sources
+						netMutex.Unlock()
+						go refreshConnectedClients()
 					case "WiFiSSID":
 						globalSettings.WiFiSSID = val.(string)
 						resetWiFi = true
@@ -796,6 +930,7 @@ func managementInterface() {
 	situationUpdate = NewUIBroadcaster()
 	weatherRawUpdate = NewUIBroadcaster()
 	gdl90Update = NewUIBroadcaster()
+	alertUpdate = NewUIBroadcaster()
 
 	http.HandleFunc("/", defaultServer)
 	http.Handle("/logs/", http.StripPrefix("/logs/", http.FileServer(http.Dir("/var/log"))))
@@ -831,6 +966,12 @@ func managementInterface() {
 				Handler: websocket.Handler(handleTrafficWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/alerts",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleAlertsWS)}
+			s.ServeHTTP(w, req)
+		})
 
 	http.HandleFunc("/jsonio",
 		func(w http.ResponseWriter, req *http.Request) {
@@ -843,12 +984,21 @@ func managementInterface() {
 	http.HandleFunc("/getSituation", handleSituationRequest)
 	http.HandleFunc("/getTowers", handleTowersRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
+	http.HandleFunc("/data/aircraft.json", handleAircraftJSONRequest)
+	http.HandleFunc("/data/receiver.json", handleReceiverJSONRequest)
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
 	http.HandleFunc("/setSettings", handleSettingsSetRequest)
 	http.HandleFunc("/restart", handleRestartRequest)
 	http.HandleFunc("/shutdown", handleShutdownRequest)
 	http.HandleFunc("/reboot", handleRebootRequest)
 	http.HandleFunc("/getClients", handleClientsGetRequest)
+	http.HandleFunc("/getClientSessions", handleClientSessionsGetRequest)
+	http.HandleFunc("/setClientCapability", handleClientCapabilityRequest)
+	http.HandleFunc("/resetClientQueue", handleClientQueueResetRequest)
+	http.HandleFunc("/kickClient", handleClientKickRequest)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/weather/graphics", handleWeatherGraphicsRequest)
+	http.HandleFunc("/nexrad/", handleNEXRADRequest)
 	http.HandleFunc("/updateUpload", handleUpdatePostRequest)
 	http.HandleFunc("/roPartitionRebuild", handleroPartitionRebuild)
 	http.HandleFunc("/develmodetoggle", handleDevelModeToggle)
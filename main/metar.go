@@ -0,0 +1,377 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metar.go: METAR/SPECI and TAF parsing - wind, visibility, weather, clouds, temperature, altimeter and
+	 TAF change groups, with the VFR/MVFR/IFR/LIFR flight category. Sent with the /weather messages.
+*/
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	FLIGHT_CATEGORY_VFR  = "VFR"  // Ceiling above 3,000' and visibility above 5 SM.
+	FLIGHT_CATEGORY_MVFR = "MVFR" // Ceiling 1,000' to 3,000' and/or visibility 3 to 5 SM.
+	FLIGHT_CATEGORY_IFR  = "IFR"  // Ceiling 500' to below 1,000' and/or visibility 1 to below 3 SM.
+	FLIGHT_CATEGORY_LIFR = "LIFR" // Ceiling below 500' and/or visibility below 1 SM.
+
+	metersPerStatuteMile = 1609.344
+	inHgPerHPa           = 0.0295300
+)
+
+var (
+	metarWindRegexp       = regexp.MustCompile(`^(VRB|\d{3})(\d{2,3})(?:G(\d{2,3}))?(KT|MPS)$`)
+	metarWindVarRegexp    = regexp.MustCompile(`^(\d{3})V(\d{3})$`)
+	metarVisibilityRegexp = regexp.MustCompile(`^([PM])?(?:(\d+)|(\d+)/(\d+))SM$`)
+	metarMetricVisRegexp  = regexp.MustCompile(`^\d{4}$`)
+	metarCloudRegexp      = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)(CB|TCU)?$`)
+	metarTempRegexp       = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	metarAltimeterRegexp  = regexp.MustCompile(`^(?:A(\d{4})|Q(\d{4})|QNH(\d{4})INS)$`)
+	metarWeatherRegexp    = regexp.MustCompile(`^(?:[-+]|VC)?(?:MI|PR|BC|DR|BL|SH|TS|FZ)?(?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)*$`)
+	tafValidRegexp        = regexp.MustCompile(`^(\d{4})/(\d{4})$`)
+	tafFromRegexp         = regexp.MustCompile(`^FM(\d{6})$`)
+	tafProbRegexp         = regexp.MustCompile(`^PROB(\d{2})$`)
+)
+
+type WeatherWind struct {
+	Direction    int  // Degrees true. 0 if variable or calm.
+	Variable     bool // "VRB".
+	VariableFrom *int `json:",omitempty"` // "dddVddd" - direction varying between VariableFrom and VariableTo.
+	VariableTo   *int `json:",omitempty"`
+	Speed        int  // Knots.
+	Gust         int  // Knots. 0 if no gusts.
+}
+
+type WeatherCloudLayer struct {
+	Cover string // FEW, SCT, BKN, OVC or VV (vertical visibility).
+	Base  *int   `json:",omitempty"` // Feet AGL. Nil if not reported ("///").
+	Type  string `json:",omitempty"` // CB or TCU.
+}
+
+// Conditions reported in a METAR, or forecast for a TAF period.
+type WeatherConditions struct {
+	Wind              *WeatherWind `json:",omitempty"`
+	Visibility        *float64     `json:",omitempty"` // Statute miles.
+	VisibilityGreater bool         // "P6SM", "9999" - visibility is greater than Visibility.
+	VisibilityLess    bool         // "M1/4SM" - visibility is less than Visibility.
+	Weather           []string     // Present weather groups - "-RA", "+TSRA", "VCSH", "BR", ...
+	Clouds            []WeatherCloudLayer
+	Clear             bool   // CLR, SKC, NSC or NCD - no clouds reported.
+	Ceiling           *int   `json:",omitempty"` // Feet AGL - the lowest broken or overcast layer, or vertical visibility. Nil if none.
+	FlightCategory    string // VFR, MVFR, IFR or LIFR. Empty if neither visibility nor clouds were reported.
+}
+
+type METAR struct {
+	Type      string // METAR or SPECI.
+	Station   string
+	Time      string // ddhhmmZ.
+	Auto      bool
+	Corrected bool
+	WeatherConditions
+	Temperature *int     `json:",omitempty"` // Degrees C.
+	Dewpoint    *int     `json:",omitempty"` // Degrees C.
+	Altimeter   *float64 `json:",omitempty"` // inHg.
+	Remarks     string
+}
+
+// A TAF forecast period. For BECMG, TEMPO and PROB periods, only the conditions that change are given
+// and FlightCategory is from those.
+type TAFPeriod struct {
+	Type        string // BASE (the initial forecast), FM, BECMG, TEMPO, PROB30, PROB40, PROB30 TEMPO or PROB40 TEMPO.
+	From        string // ddhh or, for FM, ddhhmm.
+	To          string // ddhh. Empty for BASE and FM - until the next FM period or the end of the TAF.
+	Probability int    `json:",omitempty"` // Percent, for PROB periods.
+	WeatherConditions
+}
+
+type TAF struct {
+	Station   string
+	IssueTime string // ddhhmmZ. Empty if not included.
+	ValidFrom string // ddhh.
+	ValidTo   string // ddhh.
+	Amended   bool
+	Corrected bool
+	Periods   []TAFPeriod
+}
+
+// weatherTokens splits a text report into groups, dropping the trailing '='.
+func weatherTokens(msg string) []string {
+	return strings.Fields(strings.TrimSpace(strings.Replace(msg, "=", " ", -1)))
+}
+
+func metarTemperature(s string) int {
+	if strings.HasPrefix(s, "M") {
+		v, _ := strconv.Atoi(s[1:])
+		return -v
+	}
+	v, _ := strconv.Atoi(s)
+	return v
+}
+
+// parseWeatherGroup adds group 'tokens[i]' to 'c', if it is a wind, visibility, weather or cloud group.
+// Returns the number of tokens used - 0 if it isn't one of those groups.
+func (c *WeatherConditions) parseWeatherGroup(tokens []string, i int) int {
+	t := tokens[i]
+	if m := metarWindRegexp.FindStringSubmatch(t); m != nil {
+		w := new(WeatherWind)
+		if m[1] == "VRB" {
+			w.Variable = true
+		} else {
+			w.Direction, _ = strconv.Atoi(m[1])
+		}
+		w.Speed, _ = strconv.Atoi(m[2])
+		if len(m[3]) > 0 {
+			w.Gust, _ = strconv.Atoi(m[3])
+		}
+		if m[4] == "MPS" {
+			w.Speed = int(float64(w.Speed)*1.943844 + 0.5)
+			w.Gust = int(float64(w.Gust)*1.943844 + 0.5)
+		}
+		c.Wind = w
+		return 1
+	}
+	if m := metarWindVarRegexp.FindStringSubmatch(t); m != nil && c.Wind != nil {
+		from, _ := strconv.Atoi(m[1])
+		to, _ := strconv.Atoi(m[2])
+		c.Wind.VariableFrom, c.Wind.VariableTo = &from, &to
+		return 1
+	}
+
+	// Visibility. Whole and fractional statute miles may be split - "1 1/2SM".
+	if _, err := strconv.Atoi(t); err == nil && len(t) == 1 && i+1 < len(tokens) {
+		if m := metarVisibilityRegexp.FindStringSubmatch(tokens[i+1]); m != nil && len(m[3]) > 0 {
+			whole, _ := strconv.Atoi(t)
+			num, _ := strconv.Atoi(m[3])
+			den, _ := strconv.Atoi(m[4])
+			if den > 0 {
+				v := float64(whole) + float64(num)/float64(den)
+				c.Visibility = &v
+				return 2
+			}
+		}
+	}
+	if m := metarVisibilityRegexp.FindStringSubmatch(t); m != nil {
+		var v float64
+		if len(m[2]) > 0 {
+			n, _ := strconv.Atoi(m[2])
+			v = float64(n)
+		} else {
+			num, _ := strconv.Atoi(m[3])
+			den, _ := strconv.Atoi(m[4])
+			if den == 0 {
+				return 0
+			}
+			v = float64(num) / float64(den)
+		}
+		c.Visibility = &v
+		c.VisibilityGreater = m[1] == "P"
+		c.VisibilityLess = m[1] == "M"
+		return 1
+	}
+	if metarMetricVisRegexp.MatchString(t) && c.Visibility == nil {
+		meters, _ := strconv.Atoi(t)
+		v := float64(meters) / metersPerStatuteMile
+		c.Visibility = &v
+		c.VisibilityGreater = meters == 9999 // 10 km or more.
+		return 1
+	}
+
+	if m := metarCloudRegexp.FindStringSubmatch(t); m != nil {
+		layer := WeatherCloudLayer{Cover: m[1], Type: m[3]}
+		if m[2] != "///" {
+			base, _ := strconv.Atoi(m[2])
+			base *= 100
+			layer.Base = &base
+			if (m[1] == "BKN" || m[1] == "OVC" || m[1] == "VV") && (c.Ceiling == nil || base < *c.Ceiling) {
+				c.Ceiling = &base
+			}
+		}
+		c.Clouds = append(c.Clouds, layer)
+		return 1
+	}
+	switch t {
+	case "CLR", "SKC", "NSC", "NCD":
+		c.Clear = true
+		return 1
+	case "CAVOK": // Visibility 10 km or more, no clouds below 5,000', no significant weather.
+		v := 10000 / metersPerStatuteMile
+		c.Visibility = &v
+		c.VisibilityGreater = true
+		c.Clear = true
+		return 1
+	case "NSW": // No significant weather.
+		c.Weather = append(c.Weather, t)
+		return 1
+	}
+	if len(t) >= 2 && metarWeatherRegexp.MatchString(t) {
+		c.Weather = append(c.Weather, t)
+		return 1
+	}
+	return 0
+}
+
+// setFlightCategory computes the flight category from the visibility and ceiling.
+func (c *WeatherConditions) setFlightCategory() {
+	if c.Visibility == nil && len(c.Clouds) == 0 && !c.Clear {
+		c.FlightCategory = ""
+		return
+	}
+	ceiling := 1000000 // Unlimited.
+	if c.Ceiling != nil {
+		ceiling = *c.Ceiling
+	}
+	vis := 1000000.0 // Unknown - use the ceiling only.
+	if c.Visibility != nil {
+		vis = *c.Visibility
+	}
+	switch {
+	case ceiling < 500 || vis < 1:
+		c.FlightCategory = FLIGHT_CATEGORY_LIFR
+	case ceiling < 1000 || vis < 3:
+		c.FlightCategory = FLIGHT_CATEGORY_IFR
+	case ceiling <= 3000 || vis <= 5:
+		c.FlightCategory = FLIGHT_CATEGORY_MVFR
+	default:
+		c.FlightCategory = FLIGHT_CATEGORY_VFR
+	}
+}
+
+// parseMETAR parses a METAR or SPECI. Returns nil if it isn't one.
+func parseMETAR(msg string) *METAR {
+	tokens := weatherTokens(msg)
+	if len(tokens) < 3 || (tokens[0] != "METAR" && tokens[0] != "SPECI") {
+		return nil
+	}
+	m := &METAR{Type: tokens[0], Station: tokens[1]}
+	i := 2
+	if strings.HasSuffix(tokens[i], "Z") {
+		m.Time = tokens[i]
+		i++
+	}
+	for ; i < len(tokens); i++ {
+		t := tokens[i]
+		if t == "RMK" {
+			m.Remarks = strings.Join(tokens[i+1:], " ")
+			break
+		}
+		switch t {
+		case "AUTO":
+			m.Auto = true
+			continue
+		case "COR":
+			m.Corrected = true
+			continue
+		}
+		if n := m.parseWeatherGroup(tokens, i); n > 0 {
+			i += n - 1
+			continue
+		}
+		if x := metarTempRegexp.FindStringSubmatch(t); x != nil {
+			temp := metarTemperature(x[1])
+			m.Temperature = &temp
+			if len(x[2]) > 0 {
+				dewpoint := metarTemperature(x[2])
+				m.Dewpoint = &dewpoint
+			}
+			continue
+		}
+		if x := metarAltimeterRegexp.FindStringSubmatch(t); x != nil {
+			var alt float64
+			if len(x[2]) > 0 {
+				hPa, _ := strconv.Atoi(x[2])
+				alt = float64(hPa) * inHgPerHPa
+			} else {
+				v, _ := strconv.Atoi(x[1] + x[3])
+				alt = float64(v) / 100
+			}
+			m.Altimeter = &alt
+			continue
+		}
+		// Runway visual range and anything else not decoded are skipped.
+	}
+	m.setFlightCategory()
+	return m
+}
+
+// parseTAF parses a TAF or amended TAF. Returns nil if it isn't one.
+func parseTAF(msg string) *TAF {
+	tokens := weatherTokens(msg)
+	if len(tokens) < 3 || (tokens[0] != "TAF" && tokens[0] != "TAF.AMD") {
+		return nil
+	}
+	taf := &TAF{Amended: tokens[0] == "TAF.AMD"}
+	i := 1
+	for ; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "AMD":
+			taf.Amended = true
+			continue
+		case "COR":
+			taf.Corrected = true
+			continue
+		}
+		break
+	}
+	if i >= len(tokens) {
+		return nil
+	}
+	taf.Station = tokens[i]
+	i++
+	if i < len(tokens) && strings.HasSuffix(tokens[i], "Z") {
+		taf.IssueTime = tokens[i]
+		i++
+	}
+	if i < len(tokens) {
+		if m := tafValidRegexp.FindStringSubmatch(tokens[i]); m != nil {
+			taf.ValidFrom, taf.ValidTo = m[1], m[2]
+			i++
+		}
+	}
+
+	period := &TAFPeriod{Type: "BASE", From: taf.ValidFrom}
+	for ; i < len(tokens); i++ {
+		t := tokens[i]
+		var next *TAFPeriod
+		if m := tafFromRegexp.FindStringSubmatch(t); m != nil {
+			next = &TAFPeriod{Type: "FM", From: m[1]}
+		} else if m := tafProbRegexp.FindStringSubmatch(t); m != nil {
+			next = &TAFPeriod{Type: t}
+			next.Probability, _ = strconv.Atoi(m[1])
+			if i+1 < len(tokens) && tokens[i+1] == "TEMPO" {
+				next.Type += " TEMPO"
+				i++
+			}
+		} else if t == "BECMG" || t == "TEMPO" {
+			next = &TAFPeriod{Type: t}
+		}
+		if next != nil {
+			period.setFlightCategory()
+			taf.Periods = append(taf.Periods, *period)
+			period = next
+			if period.Type != "FM" && i+1 < len(tokens) {
+				if m := tafValidRegexp.FindStringSubmatch(tokens[i+1]); m != nil {
+					period.From, period.To = m[1], m[2]
+					i++
+				}
+			}
+			continue
+		}
+		if t == "AMD" { // "AMD NOT SKED", "AMD LTD TO ...", ... - the rest is remarks.
+			break
+		}
+		if n := period.parseWeatherGroup(tokens, i); n > 0 {
+			i += n - 1
+		}
+		// Altimeter, temperature forecasts, wind shear and anything else not decoded are skipped.
+	}
+	period.setFlightCategory()
+	taf.Periods = append(taf.Periods, *period)
+	return taf
+}
@@ -0,0 +1,170 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metar_test.go: METAR/SPECI and TAF parsing, and flight category.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const noValue = -1 // Visibility or ceiling not reported.
+
+var metarTests = []struct {
+	msg        string
+	visibility float64
+	ceiling    int
+	category   string
+}{
+	{"METAR KSFO 161856Z 29012KT 10SM FEW015 SCT250 17/11 A3001 RMK AO2 SLP163 T01670111=", 10, noValue, FLIGHT_CATEGORY_VFR},
+	{"METAR KDEN 161853Z 34008G18KT 6SM HZ BKN030 OVC080 22/M02 A3018 RMK AO2", 6, 3000, FLIGHT_CATEGORY_MVFR},
+	{"METAR KJFK 161851Z 16009KT 3SM BR BKN012 OVC020 14/13 A2998 RMK AO2", 3, 1200, FLIGHT_CATEGORY_MVFR},
+	{"METAR KBOS 161854Z 05010KT 1 1/2SM -RA BR OVC008 09/08 A2981 RMK AO2 P0004", 1.5, 800, FLIGHT_CATEGORY_IFR},
+	{"METAR KPWM 161853Z AUTO 02006KT 3/4SM -SN BKN005 OVC011 M01/M02 A2987 RMK AO2", 0.75, 500, FLIGHT_CATEGORY_LIFR},
+	{"SPECI KORD 161912Z 00000KT M1/4SM FG VV002 04/04 A3012 RMK AO2", 0.25, 200, FLIGHT_CATEGORY_LIFR},
+	{"METAR KLAX 161853Z 25010KT 10SM CLR 21/12 A2995", 10, noValue, FLIGHT_CATEGORY_VFR},
+	{"METAR EGLL 161850Z 24012KT 210V270 CAVOK 15/08 Q1018", 10000 / metersPerStatuteMile, noValue, FLIGHT_CATEGORY_VFR},
+}
+
+func TestParseMETAR(t *testing.T) {
+	for _, tc := range metarTests {
+		m := parseMETAR(tc.msg)
+		if m == nil {
+			t.Errorf("%s: not parsed", tc.msg)
+			continue
+		}
+		checkConditions(t, tc.msg, m.WeatherConditions, tc.visibility, tc.ceiling, tc.category)
+	}
+
+	m := parseMETAR(metarTests[5].msg)
+	if m.Type != "SPECI" || m.Station != "KORD" || m.Time != "161912Z" || !m.VisibilityLess {
+		t.Errorf("SPECI: decoded %+v", m)
+	}
+	if m.Temperature == nil || *m.Temperature != 4 || m.Altimeter == nil || *m.Altimeter != 30.12 {
+		t.Errorf("SPECI: temperature or altimeter not decoded")
+	}
+	if parseMETAR("TAF KSEA 161720Z 1618/1724 20008KT P6SM SCT025") != nil {
+		t.Errorf("TAF parsed as a METAR")
+	}
+}
+
+var tafTests = []struct {
+	msg     string
+	periods []tafPeriodTest
+}{
+	{
+		"TAF KSEA 161720Z 1618/1724 20008KT P6SM SCT025 BKN040 TEMPO 1618/1622 5SM -RA BKN025 " +
+			"FM170200 18010KT 3SM BR OVC009 BECMG 1708/1710 1/2SM FG VV003 " +
+			"PROB30 TEMPO 1712/1716 2SM -DZ BR OVC006 FM171800 27010KT P6SM SKC=",
+		[]tafPeriodTest{
+			{"BASE", "1618", "", 6, 4000, FLIGHT_CATEGORY_VFR},
+			{"TEMPO", "1618", "1622", 5, 2500, FLIGHT_CATEGORY_MVFR},
+			{"FM", "170200", "", 3, 900, FLIGHT_CATEGORY_IFR},
+			{"BECMG", "1708", "1710", 0.5, 300, FLIGHT_CATEGORY_LIFR},
+			{"PROB30 TEMPO", "1712", "1716", 2, 600, FLIGHT_CATEGORY_IFR},
+			{"FM", "171800", "", 6, noValue, FLIGHT_CATEGORY_VFR},
+		},
+	},
+	{
+		"TAF AMD EGLL 161700Z 1618/1724 24010KT CAVOK BECMG 1702/1705 4000 BR PROB40 1705/1708 0800 FG",
+		[]tafPeriodTest{
+			{"BASE", "1618", "", 10000 / metersPerStatuteMile, noValue, FLIGHT_CATEGORY_VFR},
+			{"BECMG", "1702", "1705", 4000 / metersPerStatuteMile, noValue, FLIGHT_CATEGORY_IFR},
+			{"PROB40", "1705", "1708", 800 / metersPerStatuteMile, noValue, FLIGHT_CATEGORY_LIFR},
+		},
+	},
+}
+
+type tafPeriodTest struct {
+	typ        string
+	from, to   string
+	visibility float64
+	ceiling    int
+	category   string
+}
+
+func TestParseTAF(t *testing.T) {
+	for _, tc := range tafTests {
+		taf := parseTAF(tc.msg)
+		if taf == nil {
+			t.Errorf("%s: not parsed", tc.msg)
+			continue
+		}
+		if taf.ValidFrom != "1618" || taf.ValidTo != "1724" {
+			t.Errorf("%s: valid %s/%s", taf.Station, taf.ValidFrom, taf.ValidTo)
+		}
+		if len(taf.Periods) != len(tc.periods) {
+			t.Errorf("%s: %d periods, expected %d", taf.Station, len(taf.Periods), len(tc.periods))
+			continue
+		}
+		for i, p := range tc.periods {
+			tp := taf.Periods[i]
+			if tp.Type != p.typ || tp.From != p.from || tp.To != p.to {
+				t.Errorf("%s: period %d is %s %s/%s, expected %s %s/%s", taf.Station, i, tp.Type, tp.From, tp.To, p.typ, p.from, p.to)
+			}
+			checkConditions(t, taf.Station+" "+p.typ, tp.WeatherConditions, p.visibility, p.ceiling, p.category)
+		}
+	}
+
+	taf := parseTAF(tafTests[1].msg)
+	if !taf.Amended || taf.Station != "EGLL" || taf.Periods[2].Probability != 40 {
+		t.Errorf("amended TAF: decoded %+v", taf)
+	}
+}
+
+func TestSetFlightCategory(t *testing.T) {
+	tests := []struct {
+		visibility float64
+		ceiling    int
+		category   string
+	}{
+		{10, 3100, FLIGHT_CATEGORY_VFR},
+		{10, 3000, FLIGHT_CATEGORY_MVFR},
+		{5, noValue, FLIGHT_CATEGORY_MVFR},
+		{10, 999, FLIGHT_CATEGORY_IFR},
+		{2.5, noValue, FLIGHT_CATEGORY_IFR},
+		{1, 500, FLIGHT_CATEGORY_IFR},
+		{10, 400, FLIGHT_CATEGORY_LIFR},
+		{0.75, noValue, FLIGHT_CATEGORY_LIFR},
+		{noValue, 800, FLIGHT_CATEGORY_IFR}, // Ceiling only.
+		{noValue, noValue, ""},              // Nothing reported.
+	}
+	for _, tc := range tests {
+		var c WeatherConditions
+		if tc.visibility != noValue {
+			c.Visibility = &tc.visibility
+		}
+		if tc.ceiling != noValue {
+			c.Ceiling = &tc.ceiling
+			c.Clouds = []WeatherCloudLayer{{Cover: "OVC", Base: &tc.ceiling}}
+		}
+		c.setFlightCategory()
+		if c.FlightCategory != tc.category {
+			t.Errorf("visibility %.2f, ceiling %d: %q, expected %q", tc.visibility, tc.ceiling, c.FlightCategory, tc.category)
+		}
+	}
+}
+
+func checkConditions(t *testing.T, name string, c WeatherConditions, visibility float64, ceiling int, category string) {
+	switch {
+	case visibility == noValue && c.Visibility != nil:
+		t.Errorf("%s: visibility %.2f, expected none", name, *c.Visibility)
+	case visibility != noValue && (c.Visibility == nil || math.Abs(*c.Visibility-visibility) > 0.001):
+		t.Errorf("%s: visibility %v, expected %.2f", name, c.Visibility, visibility)
+	}
+	switch {
+	case ceiling == noValue && c.Ceiling != nil:
+		t.Errorf("%s: ceiling %d, expected none", name, *c.Ceiling)
+	case ceiling != noValue && (c.Ceiling == nil || *c.Ceiling != ceiling):
+		t.Errorf("%s: ceiling %v, expected %d", name, c.Ceiling, ceiling)
+	}
+	if c.FlightCategory != category {
+		t.Errorf("%s: flight category %q, expected %q", name, c.FlightCategory, category)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metrics.go: Prometheus metrics for the main daemon, served on /metrics - message rates, ADS-B tower
+	 signal, traffic, GPS, AHRS, client queues, CPU temperature and datalog backlog.
+*/
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labelled metrics, updated by updateMetrics(). Everything else is read from globalStatus and
+// mySituation when scraped.
+var (
+	towerSignalStrength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "stratux",
+			Name:      "tower_signal_strength_db",
+			Help:      "Average RSSI of the messages received from an ADS-B tower in the last minute.",
+		},
+		[]string{"tower"},
+	)
+
+	towerMessages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "stratux",
+			Name:      "tower_messages_last_minute",
+			Help:      "Messages received from an ADS-B tower in the last minute.",
+		},
+		[]string{"tower"},
+	)
+
+	trafficTargets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "stratux",
+			Name:      "traffic_targets",
+			Help:      "Traffic targets being tracked, by source of the last message.",
+		},
+		[]string{"source"},
+	)
+
+	clientQueueMessages = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "stratux",
+			Name:      "client_queue_messages",
+			Help:      "Messages queued for a network client.",
+		},
+		[]string{"client", "protocol"},
+	)
+
+	clientQueueBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "stratux",
+			Name:      "client_queue_bytes",
+			Help:      "Bytes queued for a network client.",
+		},
+		[]string{"client", "protocol"},
+	)
+)
+
+func newStatusGauge(name, help string, f func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: "stratux", Name: name, Help: help}, f)
+}
+
+func newStatusCounter(name, help string, f func() float64) prometheus.CounterFunc {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: "stratux", Name: name, Help: help}, f)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// updateMetrics refreshes the labelled metrics. Towers and clients that have gone away are removed.
+func updateMetrics() {
+	ADSBTowerMutex.Lock()
+	towerSignalStrength.Reset()
+	towerMessages.Reset()
+	for k, tower := range ADSBTowers {
+		towerSignalStrength.WithLabelValues(k).Set(tower.Signal_strength_last_minute)
+		towerMessages.WithLabelValues(k).Set(float64(tower.Messages_last_minute))
+	}
+	ADSBTowerMutex.Unlock()
+
+	// Counted in sendTrafficUpdates().
+	trafficTargets.WithLabelValues("uat").Set(float64(globalStatus.UAT_traffic_targets_tracking))
+	trafficTargets.WithLabelValues("1090es").Set(float64(globalStatus.ES_traffic_targets_tracking))
+	trafficTargets.WithLabelValues("gdl90").Set(float64(globalStatus.GDL90Input_traffic_targets_tracking))
+
+	clientQueueMessages.Reset()
+	clientQueueBytes.Reset()
+	for _, c := range getClientSessions() {
+		clientQueueMessages.WithLabelValues(c.Client, c.Protocol).Set(float64(c.QueueMessages))
+		clientQueueBytes.WithLabelValues(c.Client, c.Protocol).Set(float64(c.QueueBytes))
+	}
+}
+
+func metricsUpdater() {
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		updateMetrics()
+		<-ticker.C
+	}
+}
+
+func initMetrics() {
+	prometheus.MustRegister(towerSignalStrength)
+	prometheus.MustRegister(towerMessages)
+	prometheus.MustRegister(trafficTargets)
+	prometheus.MustRegister(clientQueueMessages)
+	prometheus.MustRegister(clientQueueBytes)
+
+	// Message rates.
+	prometheus.MustRegister(newStatusGauge("uat_messages_last_minute", "UAT messages received in the last minute.",
+		func() float64 { return float64(globalStatus.UAT_messages_last_minute) }))
+	prometheus.MustRegister(newStatusGauge("es_messages_last_minute", "1090ES messages received in the last minute.",
+		func() float64 { return float64(globalStatus.ES_messages_last_minute) }))
+	prometheus.MustRegister(newStatusCounter("gdl90_input_messages_total", "GDL90 input messages received.",
+		func() float64 { return float64(globalStatus.GDL90Input_messages_total) }))
+	prometheus.MustRegister(newStatusCounter("network_messages_sent_total", "GDL90 messages sent to network clients.",
+		func() float64 { return float64(globalStatus.NetworkDataMessagesSent) }))
+	prometheus.MustRegister(newStatusCounter("network_bytes_sent_total", "GDL90 bytes sent to network clients.",
+		func() float64 { return float64(globalStatus.NetworkDataBytesSent) }))
+	prometheus.MustRegister(newStatusGauge("connected_users", "Network clients receiving GDL90.",
+		func() float64 { return float64(globalStatus.Connected_Users) }))
+
+	// GPS.
+	prometheus.MustRegister(newStatusGauge("gps_connected", "1 if a GPS is connected.",
+		func() float64 { return boolMetric(globalStatus.GPS_connected) }))
+	prometheus.MustRegister(newStatusGauge("gps_fix_quality", "GPS fix quality: 0 no fix, 1 GPS, 2 SBAS/WAAS, 6 dead reckoning.",
+		func() float64 { return float64(mySituation.GPSFixQuality) }))
+	prometheus.MustRegister(newStatusGauge("gps_nacp", "GPS navigation accuracy category for position.",
+		func() float64 { return float64(mySituation.GPSNACp) }))
+	prometheus.MustRegister(newStatusGauge("gps_satellites_locked", "GPS satellites used in the position solution.",
+		func() float64 { return float64(globalStatus.GPS_satellites_locked) }))
+	prometheus.MustRegister(newStatusGauge("gps_horizontal_accuracy_meters", "Estimated GPS horizontal accuracy (95%).",
+		func() float64 { return float64(mySituation.GPSHorizontalAccuracy) }))
+
+	// AHRS.
+	prometheus.MustRegister(newStatusGauge("ahrs_status", "AHRS status bits, as in the 0x4C AHRS report: 1 GPS ground track, 2 IMU, 4 baro, 8 calibrating, 16 logging.",
+		func() float64 { return float64(mySituation.AHRSStatus) }))
+	prometheus.MustRegister(newStatusGauge("imu_connected", "1 if an IMU is connected.",
+		func() float64 { return boolMetric(globalStatus.IMUConnected) }))
+	prometheus.MustRegister(newStatusGauge("baro_connected", "1 if a pressure sensor is connected.",
+		func() float64 { return boolMetric(globalStatus.BMPConnected) }))
+
+	// System.
+	prometheus.MustRegister(newStatusGauge("cpu_temp_celsius", "CPU temperature.",
+		func() float64 { return float64(globalStatus.CPUTemp) }))
+	prometheus.MustRegister(newStatusGauge("datalog_backlog_rows", "Rows waiting to be written to the SQLite log.",
+		func() float64 {
+			return float64(len(dataLogChan) + len(dataLogWriteChan) + int(atomic.LoadInt32(&dataLogRowsQueuedForWrite)))
+		}))
+	prometheus.MustRegister(newStatusGauge("uptime_seconds", "Time since gen_gdl90 was started.",
+		func() float64 { return float64(globalStatus.Uptime) / 1000 }))
+
+	go metricsUpdater()
+}
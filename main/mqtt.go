@@ -0,0 +1,190 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mqtt.go: MQTT publisher. Sends traffic updates, situation and status snapshots, and decoded weather
+	 messages as JSON to a broker, for dashboards, loggers and home-built displays.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Topics, under settings.MQTTTopicPrefix: "traffic/<ICAO address>" (TrafficInfo, on every update),
+// "situation" (SituationData, retained), "status" (status, retained), and "weather/<type>/<location>"
+// (WeatherMessage - METAR, TAF, WINDS, PIREP, ... as received).
+const (
+	mqttSituationInterval = 1 * time.Second
+	mqttStatusInterval    = 5 * time.Second
+	mqttConnectTimeout    = 1 * time.Minute // Report a system error if not connected for this long.
+	mqttQueueSize         = 1024            // Messages waiting to be published. Dropped when full, e.g. while the broker is unreachable.
+)
+
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// Broker connection parameters. The client is recreated when any of these change.
+type mqttConfig struct {
+	broker   string
+	clientID string
+	username string
+	password string
+}
+
+var mqttOutputChan chan mqttMessage
+
+// Published and dropped message counts, copied to status by updateStatus(). Accessed atomically.
+// Kept out of the status struct so that they're 64-bit aligned on ARM.
+var mqttMessagesTotal uint64
+var mqttDroppedTotal uint64
+
+// mqttPublishJSON queues a message for the MQTT broker. It doesn't block - the message is dropped if the
+// publisher is behind or not connected.
+func mqttPublishJSON(topic string, v interface{}, retained bool) {
+	if !globalSettings.MQTTEnabled || mqttOutputChan == nil {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	prefix := strings.TrimRight(globalSettings.MQTTTopicPrefix, "/")
+	if len(prefix) > 0 {
+		topic = prefix + "/" + topic
+	}
+	select {
+	case mqttOutputChan <- mqttMessage{topic: topic, payload: payload, retained: retained}:
+	default:
+		atomic.AddUint64(&mqttDroppedTotal, 1)
+	}
+}
+
+// mqttTopicLevel makes a string safe to use as a single topic level.
+func mqttTopicLevel(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+func mqttPublishTraffic(ti TrafficInfo) {
+	mqttPublishJSON(fmt.Sprintf("traffic/%06X", ti.Icao_addr), ti, false)
+}
+
+func mqttPublishWeather(wm WeatherMessage) {
+	mqttPublishJSON("weather/"+mqttTopicLevel(wm.Type)+"/"+mqttTopicLevel(wm.Location), wm, false)
+}
+
+func newMQTTClient(c mqttConfig) mqtt.Client {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(c.broker)
+	opts.SetClientID(c.clientID)
+	opts.SetUsername(c.username)
+	opts.SetPassword(c.password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true) // Keep trying if the broker isn't up yet.
+	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetMaxReconnectInterval(1 * time.Minute)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		log.Printf("MQTT connected to %s.\n", c.broker)
+		globalStatus.MQTT_connected = true
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("MQTT connection to %s lost: %s\n", c.broker, err.Error())
+		globalStatus.MQTT_connected = false
+	})
+	return mqtt.NewClient(opts)
+}
+
+// mqttPublisher connects to the broker as settings change, and publishes queued messages.
+func mqttPublisher() {
+	var client mqtt.Client
+	var conf mqttConfig
+	var lastConnected time.Time // stratuxClock time the client was last seen connected, or created.
+
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		want := mqttConfig{
+			broker:   globalSettings.MQTTBroker,
+			clientID: globalSettings.MQTTClientID,
+			username: globalSettings.MQTTUsername,
+			password: globalSettings.MQTTPassword,
+		}
+		if len(want.clientID) == 0 {
+			want.clientID = "stratux"
+		}
+		enabled := globalSettings.MQTTEnabled && len(want.broker) > 0
+		if client != nil && (!enabled || want != conf) {
+			log.Printf("MQTT disconnecting from %s.\n", conf.broker)
+			client.Disconnect(250)
+			client = nil
+			globalStatus.MQTT_connected = false
+		}
+		if client == nil && enabled {
+			log.Printf("MQTT connecting to %s as '%s'.\n", want.broker, want.clientID)
+			conf = want
+			client = newMQTTClient(conf)
+			client.Connect() // Retried in the background until Disconnect().
+			lastConnected = stratuxClock.Time
+		}
+		if client != nil {
+			if client.IsConnectionOpen() {
+				lastConnected = stratuxClock.Time
+			} else if stratuxClock.Since(lastConnected) >= mqttConnectTimeout {
+				addSingleSystemErrorf("mqtt", "Can't connect to MQTT broker %s.", conf.broker)
+			}
+		}
+
+		// Publish until the next check.
+	publishLoop:
+		for {
+			select {
+			case <-ticker.C:
+				break publishLoop
+			case m := <-mqttOutputChan:
+				if client == nil || !client.IsConnectionOpen() {
+					atomic.AddUint64(&mqttDroppedTotal, 1)
+					continue
+				}
+				qos := globalSettings.MQTTQoS
+				if qos > 2 {
+					qos = 2
+				}
+				client.Publish(m.topic, qos, m.retained, m.payload) // Don't wait for the broker's acknowledgement.
+				atomic.AddUint64(&mqttMessagesTotal, 1)
+			}
+		}
+	}
+}
+
+// mqttSnapshotSender publishes the situation and status periodically.
+func mqttSnapshotSender() {
+	situationTicker := time.NewTicker(mqttSituationInterval)
+	statusTicker := time.NewTicker(mqttStatusInterval)
+	for {
+		select {
+		case <-situationTicker.C:
+			mqttPublishJSON("situation", &mySituation, true)
+		case <-statusTicker.C:
+			mqttPublishJSON("status", &globalStatus, true)
+		}
+	}
+}
+
+func initMQTT() {
+	mqttOutputChan = make(chan mqttMessage, mqttQueueSize)
+	go mqttPublisher()
+	go mqttSnapshotSender()
+}
@@ -10,15 +10,16 @@
 package main
 
 import (
+	"fmt"
 	"github.com/tarm/serial"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
-	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,115 +31,195 @@ type networkMessage struct {
 	msgType   uint8
 	queueable bool
 	ts        time.Time
+	traffic   []TrafficInfo // Targets for traffic reports. If set, msg is ignored and reports are encoded for each client's TrafficFilter.
+	queueKeys []string      // Queueable messages: products/locations in the message. See clientqueue.go.
+	priority  uint8         // Queueable messages: queuePriority*.
+	uplink    []byte        // UAT uplink payload. queueKeys and priority are decoded from it by setQueueKeys() when first needed.
+}
+
+// setQueueKeys decodes the queue keys and priority of an uplink the first time it is queued for a
+// client, so that uplinks nobody queues aren't decoded a second time.
+func (msg *networkMessage) setQueueKeys() {
+	if msg.uplink == nil {
+		return
+	}
+	msg.queueKeys, msg.priority = uplinkQueueKeys(msg.uplink)
+	msg.uplink = nil
 }
 
 type networkConnection struct {
 	Conn            *net.UDPConn
-	Ip              string
+	Ip              string // Client IP for unicast outputs (from DHCP leases), destination address for broadcast and multicast outputs.
 	Port            uint32
 	Capability      uint8
-	messageQueue    [][]byte // Device message queue.
-	MessageQueueLen int      // Length of the message queue. For debugging.
+	Kind            uint8        // NETWORK_OUTPUT_UNICAST, NETWORK_OUTPUT_BROADCAST, or NETWORK_OUTPUT_MULTICAST.
+	Interface       string       // Multicast outputs: interface to send on, e.g. "wlan0". Uses the routing table if empty.
+	messageQueue    *clientQueue // Device message queue.
+	MessageQueueLen int          // Length of the message queue. For debugging.
 	/*
 		Sleep mode/throttle variables. "sleep mode" is actually now just a very reduced packet rate, since we don't know positively
 		 when a client is ready to accept packets - we just assume so if we don't receive ICMP Unreachable packets in 5 secs.
 	*/
 	LastUnreachable time.Time // Last time the device sent an ICMP Unreachable packet.
 	nextMessageTime time.Time // The next time that the device is "able" to receive a message.
-	numOverflows    uint32    // Number of times the queue has overflowed - for calculating the amount to chop off from the queue.
 	SleepFlag       bool      // Whether or not this client has been marked as sleeping - only used for debugging (relies on messages being sent to update this flag in sendToAllConnectedClients()).
 	FFCrippled      bool
+	TrafficFilter   trafficFilter // Limits on the traffic sent to this client.
+	// Session statistics and controls, see clients.go.
+	connected          time.Time // When the client was connected.
+	messagesSent       uint64
+	bytesSent          uint64
+	capabilityOverride bool                // Capability was set with /setClientCapability. Settings changes don't apply to this client.
+	stateHistory       []clientStateChange // Recent sleep/throttle state changes.
 }
 
 type serialConnection struct {
 	DeviceString string
 	Baud         int
-	serialPort   *serial.Port
+	Protocol     uint8 // SERIAL_PROTOCOL_*.
+	MessageMask  uint8 // SERIAL_MSG_* GDL90 message types sent to the port. Zero sends the default for the protocol.
 }
 
-var messageQueue chan networkMessage
+// Protocols for serialConnection.
+const (
+	SERIAL_PROTOCOL_GDL90      = 0 // GDL90, as sent to UDP clients.
+	SERIAL_PROTOCOL_FLARM_NMEA = 1 // FLARM NMEA traffic and GPS sentences, see flarm.go.
+	SERIAL_PROTOCOL_GPS_NMEA   = 2 // $GPRMC and $GPGGA only.
+	SERIAL_PROTOCOL_AHRS       = 3 // GDL90 AHRS reports only.
+)
 
-var outSockets map[string]networkConnection
-var dhcpLeases map[string]string
-var pingResponse map[string]time.Time // Last time an IP responded to an "echo" response.
-var netMutex *sync.Mutex              // netMutex needs to be locked before accessing dhcpLeases, pingResponse, and outSockets and calling isSleeping() and isThrottled().
+// GDL90 message types for serialConnection.MessageMask.
+const (
+	SERIAL_MSG_HEARTBEAT     = 0x01 // Heartbeat, Stratux heartbeats.
+	SERIAL_MSG_OWNSHIP       = 0x02 // Ownship report and ownship geometric altitude.
+	SERIAL_MSG_TRAFFIC       = 0x04
+	SERIAL_MSG_UPLINK        = 0x08 // UAT uplinks (FIS-B weather).
+	SERIAL_MSG_PASSTHROUGH   = 0x10 // UAT basic and long reports.
+	SERIAL_MSG_AHRS          = 0x20
+	SERIAL_MSG_OTHER         = 0x40 // Other vendor messages.
+	SERIAL_MSG_GDL90_DEFAULT = SERIAL_MSG_HEARTBEAT | SERIAL_MSG_OWNSHIP | SERIAL_MSG_TRAFFIC | SERIAL_MSG_UPLINK | SERIAL_MSG_PASSTHROUGH | SERIAL_MSG_OTHER
+)
 
-var totalNetworkMessagesSent uint32
+// A client connected to one of the TCP output ports in settings.TCPOutputs. TCP clients don't need
+// a DHCP lease, and flow control replaces the ICMP sleep/throttle heuristics used for UDP clients:
+// tcpOutWriter() blocks while the client isn't reading, and messages build up in its queue.
+type tcpConnection struct {
+	Conn          net.Conn
+	Ip            string
+	Port          uint32 // Local port the client connected to.
+	Capability    uint8
+	TrafficFilter trafficFilter
+	queue         *tcpQueue
+	// Session statistics and controls, see clients.go.
+	connected          time.Time
+	capabilityOverride bool
+}
+
+// Messages waiting to be written to a TCP client. Non-queueable (real-time) messages are sent before
+// queueable ones, and only the most recent are kept - there's no point in sending stale traffic.
+type tcpQueue struct {
+	mu         *sync.Mutex
+	cond       *sync.Cond
+	realtime   [][]byte
+	queued     *clientQueue
+	closed     bool
+	numDropped uint32 // Number of real-time messages dropped because the client wasn't keeping up.
+	// Statistics, updated by tcpOutWriter().
+	messagesSent uint64
+	bytesSent    uint64
+}
 
 const (
-	NETWORK_GDL90_STANDARD = 1
-	NETWORK_AHRS_FFSIM     = 2
-	NETWORK_AHRS_GDL90     = 4
-	dhcp_lease_file        = "/var/lib/dhcp/dhcpd.leases"
-	dhcp_lease_dir         = "/var/lib/dhcp"
-	extra_hosts_file       = "/etc/stratux-static-hosts.conf"
+	tcpMaxRealtimeQueue = 256              // Real-time messages kept for a client that isn't reading.
+	tcpWriteTimeout     = 30 * time.Second // Disconnect clients that don't read anything for this long.
 )
 
-var dhcpLeaseDirectoryLastTest time.Time // Last time fsWriteTest() was run on the DHCP lease directory.
+func newTCPQueue() *tcpQueue {
+	q := &tcpQueue{mu: &sync.Mutex{}, queued: newClientQueue()}
+	q.cond = sync.NewCond(q.mu)
+	return q
+}
 
-// Read the "dhcpd.leases" file and parse out IP/hostname.
-func getDHCPLeases() (map[string]string, error) {
-	// Do a write test. Even if we are able to read the file, it may be out of date because there's a fs write issue.
-	// Only perform the test once every 5 minutes to minimize writes.
-	if stratuxClock.Since(dhcpLeaseDirectoryLastTest) >= 5*time.Minute {
-		err := fsWriteTest(dhcp_lease_dir)
-		if err != nil {
-			addSingleSystemErrorf("fs-write", "Write error on '%s', your EFB may have issues receiving weather and traffic.", dhcp_lease_dir)
-		}
-		dhcpLeaseDirectoryLastTest = stratuxClock.Time
-	}
-	dat, err := ioutil.ReadFile(dhcp_lease_file)
-	ret := make(map[string]string)
-	if err != nil {
-		return ret, err
+// push adds a message to the queue, dropping the oldest messages if the client isn't keeping up. 'm' is
+// the encoded message, the rest comes from 'msg'.
+func (q *tcpQueue) push(m []byte, msg networkMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
 	}
-	lines := strings.Split(string(dat), "\n")
-	open_block := false
-	block_ip := ""
-	for _, line := range lines {
-		spaced := strings.Split(line, " ")
-		if len(spaced) > 2 && spaced[0] == "lease" {
-			open_block = true
-			block_ip = spaced[1]
-		} else if open_block && len(spaced) >= 4 && spaced[2] == "client-hostname" {
-			hostname := strings.TrimRight(strings.TrimLeft(strings.Join(spaced[3:], " "), "\""), "\";")
-			ret[block_ip] = hostname
-			open_block = false
-		} else if open_block && strings.HasPrefix(spaced[0], "}") { // No hostname.
-			open_block = false
-			ret[block_ip] = ""
+	if msg.queueable {
+		q.queued.push(m, msg.queueKeys, msg.priority)
+	} else {
+		if len(q.realtime) >= tcpMaxRealtimeQueue {
+			q.realtime = q.realtime[1:]
+			q.numDropped++
 		}
+		q.realtime = append(q.realtime, m)
 	}
+	q.cond.Signal()
+}
 
-	// Add IP's set through the settings page
-	if globalSettings.StaticIps != nil {
-		for _, ip := range globalSettings.StaticIps {
-			ret[ip] = ""
-		}
+// pop waits for messages and returns them combined into one write, with the number of messages and
+// whether they are queueable. Returns ok == false when the queue has been closed.
+func (q *tcpQueue) pop() (buf []byte, n int, queueable bool, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.realtime) == 0 && q.queued.len() == 0 && !q.closed {
+		q.cond.Wait()
 	}
-
-	// Added the ability to have static IP hosts stored in /etc/stratux-static-hosts.conf
-
-	dat2, err := ioutil.ReadFile(extra_hosts_file)
-	if err != nil {
-		return ret, nil
+	if q.closed {
+		return nil, 0, false, false
 	}
-
-	iplines := strings.Split(string(dat2), "\n")
-	block_ip2 := ""
-	for _, ipline := range iplines {
-		spacedip := strings.Split(ipline, " ")
-		if len(spacedip) == 2 {
-			// The ip is in block_ip2
-			block_ip2 = spacedip[0]
-			// the hostname is here
-			ret[block_ip2] = spacedip[1]
+	if len(q.realtime) > 0 {
+		for _, m := range q.realtime {
+			buf = append(buf, m...)
 		}
+		n = len(q.realtime)
+		q.realtime = nil
+		return buf, n, false, true
+	}
+	// Combine up to 256 queued messages, as for UDP clients.
+	msgs := q.queued.pop(256)
+	for _, m := range msgs {
+		buf = append(buf, m...)
 	}
+	return buf, len(msgs), true, true
+}
 
-	return ret, nil
+func (q *tcpQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
 }
 
+var messageQueue chan networkMessage
+
+var outSockets map[string]networkConnection
+var tcpOutSockets map[string]tcpConnection // Clients connected to TCP output ports, keyed by remote 'ip:port'.
+var dhcpLeases map[string]string
+var pingResponse map[string]time.Time // Last time an IP responded to an "echo" response.
+var netMutex *sync.Mutex              // netMutex needs to be locked before accessing dhcpLeases, pingResponse, outSockets, and tcpOutSockets and calling isSleeping() and isThrottled().
+
+var totalNetworkMessagesSent uint32
+
+const (
+	NETWORK_GDL90_STANDARD = 1
+	NETWORK_AHRS_FFSIM     = 2
+	NETWORK_AHRS_GDL90     = 4
+	NETWORK_FLARM_NMEA     = 8
+	NETWORK_GPS_NMEA       = 16
+)
+
+// Kinds of networkConnection in settings.NetworkOutputs.
+const (
+	NETWORK_OUTPUT_UNICAST   = 0 // Sent to each client with a DHCP lease or static IP.
+	NETWORK_OUTPUT_BROADCAST = 1 // Sent to a broadcast address, 192.168.10.255 if Ip isn't set.
+	NETWORK_OUTPUT_MULTICAST = 2 // Sent to the multicast group in Ip.
+	defaultBroadcastIp       = "192.168.10.255"
+)
+
 /*
 	isSleeping().
 	 Check if a client identifier 'ip:port' is in either a sleep or active state.
@@ -148,6 +229,10 @@ func isSleeping(k string) bool {
 	if globalSettings.NoSleep == true {
 		return false
 	}
+	// Nobody to respond to pings for broadcast and multicast outputs.
+	if outSockets[k].Kind != NETWORK_OUTPUT_UNICAST {
+		return false
+	}
 	ipAndPort := strings.Split(k, ":")
 	// No ping response. Assume disconnected/sleeping device.
 	if lastPing, ok := pingResponse[ipAndPort[0]]; !ok || stratuxClock.Since(lastPing) > (10*time.Second) {
@@ -167,22 +252,52 @@ func isSleeping(k string) bool {
 	 ***WARNING***: netMutex must be locked before calling this function.
 */
 func isThrottled(k string) bool {
+	if outSockets[k].Kind != NETWORK_OUTPUT_UNICAST {
+		return false
+	}
 	return (rand.Int()%1000 != 0) && stratuxClock.Since(outSockets[k].LastUnreachable) < (15*time.Second)
 }
 
+// countNetworkSent updates client and broadcast/multicast output statistics.
+// ***WARNING***: netMutex must be locked before calling this function.
+func countNetworkSent(netconn *networkConnection, numMsgs int, numBytes int) {
+	netconn.messagesSent += uint64(numMsgs)
+	netconn.bytesSent += uint64(numBytes)
+	switch netconn.Kind {
+	case NETWORK_OUTPUT_BROADCAST:
+		globalStatus.NetworkBroadcastMessagesSent += uint64(numMsgs)
+		globalStatus.NetworkBroadcastBytesSent += uint64(numBytes)
+	case NETWORK_OUTPUT_MULTICAST:
+		globalStatus.NetworkMulticastMessagesSent += uint64(numMsgs)
+		globalStatus.NetworkMulticastBytesSent += uint64(numBytes)
+	}
+}
+
 func sendToAllConnectedClients(msg networkMessage) {
-	if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
-		// It's a GDL90 message. Send to serial output channel (which may or may not cause something to happen).
-		serialOutputChan <- msg.msg
-		networkGDL90Chan <- msg.msg
+	// Serial outputs and the web UI get the unfiltered traffic. UDP and TCP outputs get it encoded
+	// for their TrafficFilter below.
+	allMsgs := [][]byte{msg.msg}
+	if msg.traffic != nil {
+		allMsgs = makeTrafficReportPackets(msg.traffic)
+	}
+	for _, m := range allMsgs {
+		// Send to serial output channel (which may or may not cause something to happen).
+		serialOutputChan <- networkMessage{msg: m, msgType: msg.msgType, queueable: msg.queueable, ts: msg.ts}
+		if (msg.msgType & NETWORK_GDL90_STANDARD) != 0 {
+			networkGDL90Chan <- m
+		}
 	}
 
+	// Traffic reports encoded for each distinct traffic filter.
+	filteredTraffic := make(map[trafficFilter][][]byte)
+
 	netMutex.Lock()
 	defer netMutex.Unlock()
 	for k, netconn := range outSockets {
 		sleepFlag := isSleeping(k)
 
 		netconn.SleepFlag = sleepFlag
+		updateClientState(&netconn)
 		outSockets[k] = netconn
 
 		// Check if this port is able to accept the type of message we're sending.
@@ -191,39 +306,174 @@ func sendToAllConnectedClients(msg networkMessage) {
 		}
 		// Send non-queueable messages immediately, or discard if the client is in sleep mode.
 
-		if !sleepFlag {
-			netconn.numOverflows = 0 // Reset the overflow counter whenever the client is not sleeping so that we're not penalizing future sleepmodes.
-		}
-
 		if !msg.queueable {
 			if sleepFlag {
 				continue
 			}
-			netconn.Conn.Write(msg.msg) // Write immediately.
-			totalNetworkMessagesSent++
-			globalStatus.NetworkDataMessagesSent++
-			globalStatus.NetworkDataMessagesSentNonqueueable++
-			globalStatus.NetworkDataBytesSent += uint64(len(msg.msg))
-			globalStatus.NetworkDataBytesSentNonqueueable += uint64(len(msg.msg))
+			msgs := [][]byte{msg.msg}
+			if msg.traffic != nil {
+				var ok bool
+				if msgs, ok = filteredTraffic[netconn.TrafficFilter]; !ok {
+					msgs = makeTrafficReportPackets(filterTraffic(msg.traffic, netconn.TrafficFilter))
+					filteredTraffic[netconn.TrafficFilter] = msgs
+				}
+			}
+			for _, m := range msgs {
+				netconn.Conn.Write(m) // Write immediately.
+				countNetworkSent(&netconn, 1, len(m))
+				totalNetworkMessagesSent++
+				globalStatus.NetworkDataMessagesSent++
+				globalStatus.NetworkDataMessagesSentNonqueueable++
+				globalStatus.NetworkDataBytesSent += uint64(len(m))
+				globalStatus.NetworkDataBytesSentNonqueueable += uint64(len(m))
+			}
+			outSockets[k] = netconn
 		} else {
-			// Queue the message if the message is "queueable".
-			if len(netconn.messageQueue) >= maxUserMsgQueueSize { // Too many messages queued? Drop the oldest.
+			// Queue the message if the message is "queueable". Replaces older copies of the same products, and drops the
+			// oldest, lowest priority messages if the queue is full.
+			msg.setQueueKeys()
+			numDropped := netconn.messageQueue.numDropped
+			netconn.messageQueue.push(msg.msg, msg.queueKeys, msg.priority)
+			if numDropped == 0 && netconn.messageQueue.numDropped > 0 {
 				log.Printf("%s:%d - message queue overflow.\n", netconn.Ip, netconn.Port)
-				netconn.numOverflows++
-				s := 2 * netconn.numOverflows // Double the amount we chop off on each overflow.
-				if int(s) >= len(netconn.messageQueue) {
-					netconn.messageQueue = make([][]byte, 0)
-				} else {
-					netconn.messageQueue = netconn.messageQueue[s:]
-				}
 			}
-			netconn.messageQueue = append(netconn.messageQueue, msg.msg) // each netconn.messageQueue is therefore an array (well, a slice) of formatted GDL90 messages
 			outSockets[k] = netconn
 		}
 	}
+
+	for _, tcpconn := range tcpOutSockets {
+		if (tcpconn.Capability & msg.msgType) == 0 {
+			continue
+		}
+		msgs := [][]byte{msg.msg}
+		if msg.traffic != nil {
+			var ok bool
+			if msgs, ok = filteredTraffic[tcpconn.TrafficFilter]; !ok {
+				msgs = makeTrafficReportPackets(filterTraffic(msg.traffic, tcpconn.TrafficFilter))
+				filteredTraffic[tcpconn.TrafficFilter] = msgs
+			}
+		}
+		if msg.queueable {
+			msg.setQueueKeys()
+		}
+		for _, m := range msgs {
+			tcpconn.queue.push(m, msg)
+		}
+	}
+}
+
+// tcpOutWriter writes messages queued for a TCP client. Writes block while the client isn't reading,
+// so its queue fills up (and eventually overflows) instead of messages being sent into the void.
+// The client is disconnected on error or if it doesn't read anything for tcpWriteTimeout.
+func tcpOutWriter(k string, conn net.Conn, q *tcpQueue) {
+	for {
+		buf, n, queueable, ok := q.pop()
+		if !ok {
+			break
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if _, err := conn.Write(buf); err != nil {
+			log.Printf("TCP client %s disconnected: %s\n", k, err.Error())
+			break
+		}
+		q.mu.Lock()
+		q.messagesSent += uint64(n)
+		q.bytesSent += uint64(len(buf))
+		q.mu.Unlock()
+		netMutex.Lock()
+		totalNetworkMessagesSent += uint32(n)
+		globalStatus.NetworkDataMessagesSent += uint64(n)
+		globalStatus.NetworkDataBytesSent += uint64(len(buf))
+		if !queueable {
+			globalStatus.NetworkDataMessagesSentNonqueueable += uint64(n)
+			globalStatus.NetworkDataBytesSentNonqueueable += uint64(len(buf))
+		}
+		netMutex.Unlock()
+	}
+	q.close()
+	conn.Close()
+	netMutex.Lock()
+	if tcpconn, ok := tcpOutSockets[k]; ok && tcpconn.queue == q {
+		delete(tcpOutSockets, k)
+	}
+	netMutex.Unlock()
+}
+
+// tcpOutAccept accepts clients on a TCP output port.
+func tcpOutAccept(ln net.Listener, port uint32) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // Listener was closed.
+		}
+		k := conn.RemoteAddr().String()
+		ip, _, err := net.SplitHostPort(k)
+		if err != nil {
+			ip = k
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(10 * time.Second)
+		}
+		netMutex.Lock()
+		tcpconn := tcpConnection{Conn: conn, Ip: ip, Port: port, queue: newTCPQueue(), connected: time.Now()}
+		for _, tcpOutput := range globalSettings.TCPOutputs {
+			if tcpOutput.Port == port {
+				tcpconn.Capability = tcpOutput.Capability
+				tcpconn.TrafficFilter = tcpOutput.TrafficFilter
+			}
+		}
+		log.Printf("TCP client connected: %s on port %d.\n", k, port)
+		tcpOutSockets[k] = tcpconn
+		netMutex.Unlock()
+		go tcpOutWriter(k, conn, tcpconn.queue)
+	}
+}
+
+// tcpOutWatcher opens and closes listeners for the ports in settings.TCPOutputs as settings change.
+func tcpOutWatcher() {
+	listeners := make(map[uint32]net.Listener)
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		wanted := make(map[uint32]bool)
+		for _, tcpOutput := range globalSettings.TCPOutputs {
+			wanted[tcpOutput.Port] = true
+		}
+		for port, ln := range listeners {
+			if wanted[port] {
+				continue
+			}
+			log.Printf("closing TCP output port %d.\n", port)
+			ln.Close()
+			delete(listeners, port)
+			netMutex.Lock()
+			for k, tcpconn := range tcpOutSockets {
+				if tcpconn.Port == port {
+					tcpconn.queue.close() // tcpOutWriter() closes the connection.
+					delete(tcpOutSockets, k)
+				}
+			}
+			netMutex.Unlock()
+		}
+		for port := range wanted {
+			if _, ok := listeners[port]; ok {
+				continue
+			}
+			ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+			if err != nil {
+				addSingleSystemErrorf(fmt.Sprintf("tcp-listen-%d", port), "Can't listen on TCP output port %d: %s", port, err.Error())
+				continue
+			}
+			log.Printf("listening on TCP output port %d.\n", port)
+			listeners[port] = ln
+			go tcpOutAccept(ln, port)
+		}
+		<-ticker.C
+	}
 }
 
-var serialOutputChan chan []byte
+var serialOutputChan chan networkMessage
+var serialOutMutex *sync.Mutex // Protects settings.SerialOutputs.
 var networkGDL90Chan chan []byte
 
 func networkOutWatcher() {
@@ -233,57 +483,168 @@ func networkOutWatcher() {
 	}
 }
 
-// Monitor serial output channel, send to serial port.
-func serialOutWatcher() {
-	// Check every 30 seconds for a serial output device.
-	serialTicker := time.NewTicker(30 * time.Second)
+// An open serial output. Messages are written by serialOutWriter() so that a slow port doesn't hold up the others.
+type serialOutPort struct {
+	conf       serialConnection // Settings the port was opened with.
+	port       *serial.Port
+	out        chan []byte
+	quit       chan bool // Closed by serialOutWatcher() to close the port.
+	done       chan bool // Closed by serialOutWriter() once the port is closed.
+	numDropped uint32    // Number of messages dropped because the port wasn't keeping up.
+}
+
+// serialMessageType returns the SERIAL_MSG_* type of a GDL90 message.
+func serialMessageType(m networkMessage) uint8 {
+	if (m.msgType & NETWORK_AHRS_GDL90) != 0 {
+		return SERIAL_MSG_AHRS
+	}
+	if len(m.msg) < 2 {
+		return SERIAL_MSG_OTHER
+	}
+	switch m.msg[1] { // Message ID, after the flag byte.
+	case 0x00, 0xCC, 'S':
+		return SERIAL_MSG_HEARTBEAT
+	case 0x0A, 0x0B:
+		return SERIAL_MSG_OWNSHIP
+	case 0x14:
+		return SERIAL_MSG_TRAFFIC
+	case MSGTYPE_UPLINK:
+		return SERIAL_MSG_UPLINK
+	case MSGTYPE_BASIC_REPORT, MSGTYPE_LONG_REPORT:
+		return SERIAL_MSG_PASSTHROUGH
+	}
+	return SERIAL_MSG_OTHER
+}
 
-	serialDev := "/dev/serialout0" //FIXME: This is temporary. Only one serial output device for now.
+// sendsMessage returns true if the message should be written to a serial output with these settings.
+func (c serialConnection) sendsMessage(m networkMessage) bool {
+	var capability uint8
+	switch c.Protocol {
+	case SERIAL_PROTOCOL_FLARM_NMEA:
+		capability = NETWORK_FLARM_NMEA
+	case SERIAL_PROTOCOL_GPS_NMEA:
+		capability = NETWORK_GPS_NMEA
+	case SERIAL_PROTOCOL_AHRS:
+		capability = NETWORK_AHRS_GDL90
+	default:
+		capability = NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90
+	}
+	if (capability & m.msgType) == 0 {
+		return false
+	}
+	if (m.msgType & (NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90)) == 0 {
+		return true // NMEA sentences aren't filtered.
+	}
+	mask := c.MessageMask
+	if mask == 0 {
+		if c.Protocol != SERIAL_PROTOCOL_GDL90 {
+			return true
+		}
+		mask = SERIAL_MSG_GDL90_DEFAULT
+	}
+	return (mask & serialMessageType(m)) != 0
+}
 
+func serialOutWriter(p *serialOutPort) {
+	defer close(p.done)
+	defer p.port.Close()
 	for {
 		select {
-		case <-serialTicker.C:
-			if _, err := os.Stat(serialDev); !os.IsNotExist(err) { // Check if the device file exists.
-				var thisSerialConn serialConnection
-				// Check if we need to start handling a new device.
-				if val, ok := globalSettings.SerialOutputs[serialDev]; !ok {
-					newSerialOut := serialConnection{DeviceString: serialDev, Baud: 38400}
-					log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", serialDev)
-					if globalSettings.SerialOutputs == nil {
-						globalSettings.SerialOutputs = make(map[string]serialConnection)
-					}
-					globalSettings.SerialOutputs[serialDev] = newSerialOut
-					saveSettings()
-					thisSerialConn = newSerialOut
-				} else {
-					thisSerialConn = val
+		case <-p.quit:
+			return
+		case m := <-p.out:
+			if _, err := p.port.Write(m); err != nil { // Unplugged. serialOutWatcher() reopens it when it's back.
+				log.Printf("serialout (%s) port err: %s. Closing port.\n", p.conf.DeviceString, err.Error())
+				return
+			}
+		}
+	}
+}
+
+// detectSerialOutputs adds new /dev/serialout* devices (see image/10-stratux.rules) to settings.SerialOutputs.
+func detectSerialOutputs() {
+	devs, _ := filepath.Glob("/dev/serialout*")
+	added := false
+	serialOutMutex.Lock()
+	for _, dev := range devs {
+		if _, ok := globalSettings.SerialOutputs[dev]; ok {
+			continue
+		}
+		log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", dev)
+		if globalSettings.SerialOutputs == nil {
+			globalSettings.SerialOutputs = make(map[string]serialConnection)
+		}
+		globalSettings.SerialOutputs[dev] = serialConnection{DeviceString: dev, Baud: 38400}
+		added = true
+	}
+	serialOutMutex.Unlock()
+	if added {
+		saveSettings()
+	}
+}
+
+// Monitor serial output channel, send to serial ports. Ports in settings.SerialOutputs are opened when the device is
+// plugged in, and reopened when their settings change.
+func serialOutWatcher() {
+	ports := make(map[string]*serialOutPort) // Open ports, keyed by device.
+	ticker := time.NewTicker(5 * time.Second)
+
+	for {
+		select {
+		case <-ticker.C:
+			detectSerialOutputs()
+			conf := make(map[string]serialConnection)
+			serialOutMutex.Lock()
+			for dev, c := range globalSettings.SerialOutputs {
+				conf[dev] = c
+			}
+			serialOutMutex.Unlock()
+
+			// Close ports that were removed or reconfigured, and forget the ones that were unplugged.
+			for dev, p := range ports {
+				select {
+				case <-p.done:
+					delete(ports, dev)
+					continue
+				default:
 				}
-				// Check if we need to open the connection now.
-				if thisSerialConn.serialPort == nil {
-					cfg := &serial.Config{Name: thisSerialConn.DeviceString, Baud: thisSerialConn.Baud}
-					p, err := serial.OpenPort(cfg)
-					if err != nil {
-						log.Printf("serialout port (%s) err: %s\n", thisSerialConn.DeviceString, err.Error())
-						break // We'll attempt again in 30 seconds.
-					} else {
-						log.Printf("opened serialout: Name: %s, Baud: %d\n", thisSerialConn.DeviceString, thisSerialConn.Baud)
-					}
-					// Save the serial port connection.
-					thisSerialConn.serialPort = p
-					globalSettings.SerialOutputs[serialDev] = thisSerialConn
+				if c, ok := conf[dev]; ok && c == p.conf {
+					continue
 				}
+				log.Printf("closing serialout %s.\n", dev)
+				close(p.quit)
+				<-p.done
+				delete(ports, dev)
 			}
 
-		case b := <-serialOutputChan:
-			if val, ok := globalSettings.SerialOutputs[serialDev]; ok {
-				if val.serialPort != nil {
-					_, err := val.serialPort.Write(b)
-					if err != nil { // Encountered an error in writing to the serial port. Close it and set Serial_out_enabled.
-						log.Printf("serialout (%s) port err: %s. Closing port.\n", val.DeviceString, err.Error())
-						val.serialPort.Close()
-						val.serialPort = nil
-						globalSettings.SerialOutputs[serialDev] = val
-					}
+			// Open configured ports that are plugged in.
+			for dev, c := range conf {
+				if _, ok := ports[dev]; ok {
+					continue
+				}
+				if _, err := os.Stat(dev); err != nil {
+					continue // Not plugged in.
+				}
+				p, err := serial.OpenPort(&serial.Config{Name: dev, Baud: c.Baud})
+				if err != nil {
+					log.Printf("serialout port (%s) err: %s\n", dev, err.Error())
+					continue // We'll attempt again in 5 seconds.
+				}
+				log.Printf("opened serialout: Name: %s, Baud: %d, Protocol: %d\n", dev, c.Baud, c.Protocol)
+				sp := &serialOutPort{conf: c, port: p, out: make(chan []byte, 1024), quit: make(chan bool), done: make(chan bool)}
+				ports[dev] = sp
+				go serialOutWriter(sp)
+			}
+
+		case m := <-serialOutputChan:
+			for _, p := range ports {
+				if !p.conf.sendsMessage(m) {
+					continue
+				}
+				select {
+				case p.out <- m.msg:
+				default:
+					p.numDropped++ // Port isn't keeping up (or has been unplugged).
 				}
 			}
 		}
@@ -299,12 +660,12 @@ func getNetworkStats() {
 	var numNonSleepingClients uint
 
 	for k, netconn := range outSockets {
-		queueBytes := 0
-		for _, msg := range netconn.messageQueue {
-			queueBytes += len(msg)
+		if netconn.Kind != NETWORK_OUTPUT_UNICAST {
+			continue
 		}
 		if globalSettings.DEBUG {
-			log.Printf("On  %s:%d,  Queue length = %d messages / %d bytes\n", netconn.Ip, netconn.Port, len(netconn.messageQueue), queueBytes)
+			q := netconn.messageQueue
+			log.Printf("On  %s:%d,  Queue length = %d messages / %d bytes, %d superseded, %d dropped\n", netconn.Ip, netconn.Port, q.len(), q.bytes(), q.numSuperseded, q.numDropped)
 		}
 		ipAndPort := strings.Split(k, ":")
 		if len(ipAndPort) != 2 {
@@ -327,7 +688,51 @@ func getNetworkStats() {
 func refreshConnectedClients() {
 	netMutex.Lock()
 	defer netMutex.Unlock()
+	// Pick up settings changes for TCP clients.
+	for k, tcpconn := range tcpOutSockets {
+		for _, tcpOutput := range globalSettings.TCPOutputs {
+			if tcpOutput.Port == tcpconn.Port {
+				if !tcpconn.capabilityOverride {
+					tcpconn.Capability = tcpOutput.Capability
+				}
+				tcpconn.TrafficFilter = tcpOutput.TrafficFilter
+				tcpOutSockets[k] = tcpconn
+			}
+		}
+	}
 	validConnections := make(map[string]bool)
+	// Broadcast and multicast outputs don't depend on DHCP leases.
+	for _, networkOutput := range globalSettings.NetworkOutputs {
+		if networkOutput.Kind == NETWORK_OUTPUT_UNICAST {
+			continue
+		}
+		ip := networkOutput.Ip
+		if networkOutput.Kind == NETWORK_OUTPUT_BROADCAST && len(ip) == 0 {
+			ip = defaultBroadcastIp
+		}
+		ipAndPort := ip + ":" + strconv.Itoa(int(networkOutput.Port))
+		if netconn, ok := outSockets[ipAndPort]; ok && netconn.Kind == networkOutput.Kind && netconn.Interface == networkOutput.Interface {
+			// Pick up settings changes.
+			if !netconn.capabilityOverride {
+				netconn.Capability = networkOutput.Capability
+			}
+			netconn.TrafficFilter = networkOutput.TrafficFilter
+			outSockets[ipAndPort] = netconn
+			validConnections[ipAndPort] = true
+			continue
+		} else if ok {
+			netconn.Conn.Close()
+			delete(outSockets, ipAndPort)
+		}
+		outConn, err := dialNetworkOutput(networkOutput.Kind, ipAndPort, networkOutput.Interface)
+		if err != nil {
+			addSingleSystemErrorf(fmt.Sprintf("net-output-%s", ipAndPort), "Can't send to %s: %s", ipAndPort, err.Error())
+			continue
+		}
+		log.Printf("opened output %s (kind %d).\n", ipAndPort, networkOutput.Kind)
+		outSockets[ipAndPort] = networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, Kind: networkOutput.Kind, Interface: networkOutput.Interface, messageQueue: newClientQueue(), TrafficFilter: networkOutput.TrafficFilter, connected: time.Now()}
+		validConnections[ipAndPort] = true
+	}
 	t, err := getDHCPLeases()
 	if err != nil {
 		log.Printf("getDHCPLeases(): %s\n", err.Error())
@@ -337,7 +742,13 @@ func refreshConnectedClients() {
 	// Client connected that wasn't before.
 	for ip, hostname := range dhcpLeases {
 		for _, networkOutput := range globalSettings.NetworkOutputs {
+			if networkOutput.Kind != NETWORK_OUTPUT_UNICAST {
+				continue
+			}
 			ipAndPort := ip + ":" + strconv.Itoa(int(networkOutput.Port))
+			if isKicked(ipAndPort) {
+				continue
+			}
 			if _, ok := outSockets[ipAndPort]; !ok {
 				log.Printf("client connected: %s:%d (%s).\n", ip, networkOutput.Port, hostname)
 				addr, err := net.ResolveUDPAddr("udp", ipAndPort)
@@ -350,8 +761,15 @@ func refreshConnectedClients() {
 					log.Printf("DialUDP(%s): %s\n", ipAndPort, err.Error())
 					continue
 				}
-				newq := make([][]byte, 0)
-				outSockets[ipAndPort] = networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, messageQueue: newq}
+				outSockets[ipAndPort] = networkConnection{Conn: outConn, Ip: ip, Port: networkOutput.Port, Capability: networkOutput.Capability, messageQueue: newClientQueue(), TrafficFilter: networkOutput.TrafficFilter, connected: time.Now()}
+			} else {
+				// Pick up settings changes.
+				netconn := outSockets[ipAndPort]
+				if !netconn.capabilityOverride {
+					netconn.Capability = networkOutput.Capability
+				}
+				netconn.TrafficFilter = networkOutput.TrafficFilter
+				outSockets[ipAndPort] = netconn
 			}
 			validConnections[ipAndPort] = true
 		}
@@ -366,6 +784,71 @@ func refreshConnectedClients() {
 	}
 }
 
+// dialNetworkOutput opens a UDP socket for a broadcast or multicast output. Go sets SO_BROADCAST on
+// all UDP sockets, so broadcast needs nothing special. Multicast is sent with a TTL of 1 (local
+// subnet only), on 'iface' if it is set.
+func dialNetworkOutput(kind uint8, ipAndPort string, iface string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", ipAndPort)
+	if err != nil {
+		return nil, err
+	}
+	if kind == NETWORK_OUTPUT_MULTICAST && !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", addr.IP.String())
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if kind == NETWORK_OUTPUT_MULTICAST {
+		p := ipv4.NewPacketConn(conn)
+		p.SetMulticastTTL(1)
+		if len(iface) > 0 {
+			ifi, err := net.InterfaceByName(iface)
+			if err == nil {
+				err = p.SetMulticastInterface(ifi)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	return conn, nil
+}
+
+// setTrafficFilter changes the traffic filter for the NetworkOutputs and TCPOutputs entries on 'port',
+// including clients that are already connected. Returns false if there is no output on that port.
+func setTrafficFilter(port uint32, f trafficFilter) bool {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	found := false
+	for i, networkOutput := range globalSettings.NetworkOutputs {
+		if networkOutput.Port == port {
+			globalSettings.NetworkOutputs[i].TrafficFilter = f
+			found = true
+		}
+	}
+	for i, tcpOutput := range globalSettings.TCPOutputs {
+		if tcpOutput.Port == port {
+			globalSettings.TCPOutputs[i].TrafficFilter = f
+			found = true
+		}
+	}
+	for k, netconn := range outSockets {
+		if netconn.Port == port {
+			netconn.TrafficFilter = f
+			outSockets[k] = netconn
+		}
+	}
+	for k, tcpconn := range tcpOutSockets {
+		if tcpconn.Port == port {
+			tcpconn.TrafficFilter = f
+			tcpOutSockets[k] = tcpconn
+		}
+	}
+	return found
+}
+
 func messageQueueSender() {
 	secondTimer := time.NewTicker(15 * time.Second) // getNetworkStats().
 	queueTimer := time.NewTicker(100 * time.Millisecond)
@@ -380,54 +863,29 @@ func messageQueueSender() {
 
 			averageSendableQueueSize := float64(0.0)
 			for k, netconn := range outSockets {
-				if len(netconn.messageQueue) > 0 && !isSleeping(k) && !isThrottled(k) {
-					averageSendableQueueSize += float64(len(netconn.messageQueue)) // Add num sendable messages.
+				if netconn.messageQueue.len() > 0 && !isSleeping(k) && !isThrottled(k) {
+					averageSendableQueueSize += float64(netconn.messageQueue.len()) // Add num sendable messages.
 
 					var queuedMsg []byte
 
 					// Combine the first 256 entries in netconn.messageQueue to avoid flooding wlan0 with too many IOPS.
 					// Need to play nice with non-queued messages, so this limits the number of entries to combine.
 					// UAT uplink block is 432 bytes, so transmit block size shouldn't be larger than 108 KiB. 10 Mbps per device would therefore be needed to send within a 100 ms window.
+					// Text weather is sent first - see clientqueue.go.
 
-					mqDepth := len(netconn.messageQueue)
-					if mqDepth > 256 {
-						mqDepth = 256
-					}
-
-					for j := 0; j < mqDepth; j++ {
-						queuedMsg = append(queuedMsg, netconn.messageQueue[j]...)
+					msgs := netconn.messageQueue.pop(256)
+					for _, m := range msgs {
+						queuedMsg = append(queuedMsg, m...)
 					}
 
-					/*
-						for j, _ := range netconn.messageQueue {
-							queuedMsg = append(queuedMsg, netconn.messageQueue[j]...)
-						}
-					*/
-
 					netconn.Conn.Write(queuedMsg)
+					countNetworkSent(&netconn, len(msgs), len(queuedMsg))
 					totalNetworkMessagesSent++
 					globalStatus.NetworkDataMessagesSent++
 					globalStatus.NetworkDataBytesSent += uint64(len(queuedMsg))
-
-					//netconn.messageQueue = [][]byte{}
-					if mqDepth < len(netconn.messageQueue) {
-						netconn.messageQueue = netconn.messageQueue[mqDepth:]
-					} else {
-						netconn.messageQueue = [][]byte{}
-					}
 					outSockets[k] = netconn
-
-					/*
-						tmpConn := netconn
-						tmpConn.Conn.Write(tmpConn.messageQueue[0])
-						totalNetworkMessagesSent++
-						globalStatus.NetworkDataMessagesSent++
-						globalStatus.NetworkDataBytesSent += uint64(len(tmpConn.messageQueue[0]))
-						tmpConn.messageQueue = tmpConn.messageQueue[1:]
-						outSockets[k] = tmpConn
-					*/
 				}
-				netconn.MessageQueueLen = len(netconn.messageQueue)
+				netconn.MessageQueueLen = netconn.messageQueue.len()
 				outSockets[k] = netconn
 			}
 
@@ -480,7 +938,10 @@ func icmpEchoSender(c *icmp.PacketConn) {
 		netMutex.Lock()
 		// Collect IPs.
 		ips := make(map[string]bool)
-		for k, _ := range outSockets {
+		for k, netconn := range outSockets {
+			if netconn.Kind != NETWORK_OUTPUT_UNICAST {
+				continue
+			}
 			ipAndPort := strings.Split(k, ":")
 			ips[ipAndPort[0]] = true
 		}
@@ -624,6 +1085,7 @@ func ffMonitor() {
 		s = strings.Replace(s, "\x00", "", -1)
 		ffIpAndPort := ip + ":4000"
 		netMutex.Lock()
+		clientApps[ip] = "ForeFlight"
 		p, ok := outSockets[ffIpAndPort]
 		if !ok {
 			// Can't do anything, the client isn't even technically connected.
@@ -641,12 +1103,16 @@ func ffMonitor() {
 }
 
 func initNetwork() {
-	messageQueue = make(chan networkMessage, 1024) // Buffered channel, 1024 messages.
-	serialOutputChan = make(chan []byte, 1024)     // Buffered channel, 1024 GDL90 messages.
+	messageQueue = make(chan networkMessage, 1024)     // Buffered channel, 1024 messages.
+	serialOutputChan = make(chan networkMessage, 1024) // Buffered channel, 1024 messages.
+	serialOutMutex = &sync.Mutex{}
 	networkGDL90Chan = make(chan []byte, 1024)
 	outSockets = make(map[string]networkConnection)
+	tcpOutSockets = make(map[string]tcpConnection)
 	pingResponse = make(map[string]time.Time)
 	netMutex = &sync.Mutex{}
+	clientApps = make(map[string]string)
+	kickedClients = make(map[string]time.Time)
 	refreshConnectedClients()
 	go monitorDHCPLeases()
 	go messageQueueSender()
@@ -654,4 +1120,5 @@ func initNetwork() {
 	go networkStatsCounter()
 	go serialOutWatcher()
 	go networkOutWatcher()
+	go tcpOutWatcher()
 }
@@ -0,0 +1,323 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nexrad.go: NEXRAD compositor. Keeps the latest regional (63) and CONUS (64) blocks received over
+	 FIS-B, and serves them as PNG slippy map tiles on /nexrad/{regional,conus}/z/x/y.png with a
+	 freshness summary on /nexrad/status.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../uatparse"
+)
+
+const (
+	NEXRAD_REGIONAL = 63
+	NEXRAD_CONUS    = 64
+
+	nexradTileSize   = 256
+	nexradMaxZoom    = 16
+	nexradBinColumns = 32 // Each block is 32 bins wide (west to east) by 4 rows (north to south).
+	nexradBinRows    = 4
+)
+
+// Blocks are dropped if they haven't been retransmitted for this long. The regional product is
+// uplinked every 2.5 minutes, CONUS every 10 minutes.
+var nexradMaxAge = map[uint32]time.Duration{
+	NEXRAD_REGIONAL: 10 * time.Minute,
+	NEXRAD_CONUS:    30 * time.Minute,
+}
+
+// Colors for the 8 intensity levels (6.24). 0 is below 5 dBZ and isn't drawn.
+var nexradColors = []color.NRGBA{
+	{0x00, 0x00, 0x00, 0x00},
+	{0x00, 0xEC, 0xEC, 0x90}, // 5-20 dBZ.
+	{0x00, 0xC8, 0x00, 0xB0}, // 20-30 dBZ.
+	{0xFF, 0xFF, 0x00, 0xC0}, // 30-40 dBZ.
+	{0xFF, 0x90, 0x00, 0xC0}, // 40-45 dBZ.
+	{0xFF, 0x00, 0x00, 0xC0}, // 45-50 dBZ.
+	{0xC0, 0x00, 0x00, 0xC0}, // 50-55 dBZ.
+	{0xFF, 0x00, 0xFF, 0xC0}, // 55+ dBZ.
+}
+
+type nexradBlockKey struct {
+	scale    int
+	latNorth float64
+	lonWest  float64
+}
+
+type nexradBlock struct {
+	block    uatparse.NEXRADBlock
+	received time.Time // stratuxClock.
+}
+
+type nexradGrid struct {
+	blocks     map[nexradBlockKey]*nexradBlock
+	lastUpdate time.Time // stratuxClock.
+	received   uint64    // Blocks received since startup.
+}
+
+// NEXRADSummary is the freshness summary of one product, returned by /nexrad/status.
+type NEXRADSummary struct {
+	Product             uint32
+	Name                string
+	Blocks              int     // Blocks currently held.
+	BlocksReceived      uint64  // Blocks received since startup, including retransmissions.
+	PrecipitationBlocks int     // Blocks with any bin drawn on the tiles.
+	LastUpdateAge       float64 // Seconds since the last block was received. -1 if none have been.
+	NewestBlockAge      float64 // Seconds. -1 if there are no blocks.
+	OldestBlockAge      float64 // Seconds. -1 if there are no blocks.
+	MaxAge              float64 // Seconds. Blocks older than this are dropped.
+	LatNorth            float64 // Bounds of the blocks held.
+	LatSouth            float64
+	LonWest             float64
+	LonEast             float64
+}
+
+var nexradGrids map[uint32]*nexradGrid
+var nexradMutex *sync.Mutex
+
+func nexradProductName(product uint32) string {
+	if product == NEXRAD_CONUS {
+		return "conus"
+	}
+	return "regional"
+}
+
+// registerNEXRADBlocks adds the blocks decoded from an uplink frame, replacing earlier copies.
+func registerNEXRADBlocks(blocks []uatparse.NEXRADBlock) {
+	nexradMutex.Lock()
+	defer nexradMutex.Unlock()
+	for _, b := range blocks {
+		grid, ok := nexradGrids[b.Radar_Type]
+		if !ok {
+			continue // Not a global block representation product.
+		}
+		k := nexradBlockKey{scale: b.Scale, latNorth: b.LatNorth, lonWest: b.LonWest}
+		grid.blocks[k] = &nexradBlock{block: b, received: stratuxClock.Time}
+		grid.lastUpdate = stratuxClock.Time
+		grid.received++
+	}
+}
+
+// nexradBinVisible returns true if a bin should be drawn. Empty CONUS blocks are filled with level 1
+// by decodeNexradFrame(), so level 1 isn't drawn for CONUS.
+func nexradBinVisible(product uint32, intensity uint16) bool {
+	if product == NEXRAD_CONUS {
+		return intensity > 1 && int(intensity) < len(nexradColors)
+	}
+	return intensity > 0 && int(intensity) < len(nexradColors)
+}
+
+func nexradHasPrecipitation(b *uatparse.NEXRADBlock) bool {
+	for _, v := range b.Intensity {
+		if nexradBinVisible(b.Radar_Type, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func getNEXRADSummary() []NEXRADSummary {
+	nexradMutex.Lock()
+	defer nexradMutex.Unlock()
+	ret := make([]NEXRADSummary, 0)
+	for _, product := range []uint32{NEXRAD_REGIONAL, NEXRAD_CONUS} {
+		grid := nexradGrids[product]
+		s := NEXRADSummary{
+			Product:        product,
+			Name:           nexradProductName(product),
+			Blocks:         len(grid.blocks),
+			BlocksReceived: grid.received,
+			LastUpdateAge:  -1,
+			NewestBlockAge: -1,
+			OldestBlockAge: -1,
+			MaxAge:         nexradMaxAge[product].Seconds(),
+		}
+		if grid.received > 0 {
+			s.LastUpdateAge = stratuxClock.Since(grid.lastUpdate).Seconds()
+		}
+		first := true
+		for _, b := range grid.blocks {
+			age := stratuxClock.Since(b.received).Seconds()
+			if nexradHasPrecipitation(&b.block) {
+				s.PrecipitationBlocks++
+			}
+			latSouth := b.block.LatNorth - b.block.Height
+			lonEast := b.block.LonWest + b.block.Width
+			if first {
+				s.NewestBlockAge, s.OldestBlockAge = age, age
+				s.LatNorth, s.LatSouth, s.LonWest, s.LonEast = b.block.LatNorth, latSouth, b.block.LonWest, lonEast
+				first = false
+				continue
+			}
+			s.NewestBlockAge = math.Min(s.NewestBlockAge, age)
+			s.OldestBlockAge = math.Max(s.OldestBlockAge, age)
+			s.LatNorth = math.Max(s.LatNorth, b.block.LatNorth)
+			s.LatSouth = math.Min(s.LatSouth, latSouth)
+			s.LonWest = math.Min(s.LonWest, b.block.LonWest)
+			s.LonEast = math.Max(s.LonEast, lonEast)
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// Web Mercator ("slippy map") pixel coordinates at zoom level 'z'.
+func nexradPixelX(lon float64, z uint) float64 {
+	return (lon + 180) / 360 * float64(int(nexradTileSize)<<z)
+}
+
+func nexradPixelY(lat float64, z uint) float64 {
+	lat = math.Max(math.Min(lat, 85.0511), -85.0511)
+	r := lat * math.Pi / 180
+	return (1 - math.Log(math.Tan(r)+1/math.Cos(r))/math.Pi) / 2 * float64(int(nexradTileSize)<<z)
+}
+
+// renderNEXRADTile draws the blocks of 'product' that fall on tile x, y at zoom level z.
+func renderNEXRADTile(product uint32, z uint, x, y int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, nexradTileSize, nexradTileSize))
+	tileX := float64(x * nexradTileSize)
+	tileY := float64(y * nexradTileSize)
+
+	nexradMutex.Lock()
+	var blocks []*nexradBlock
+	for _, b := range nexradGrids[product].blocks {
+		west := nexradPixelX(b.block.LonWest, z) - tileX
+		east := nexradPixelX(b.block.LonWest+b.block.Width, z) - tileX
+		north := nexradPixelY(b.block.LatNorth, z) - tileY
+		south := nexradPixelY(b.block.LatNorth-b.block.Height, z) - tileY
+		if east < 0 || west >= nexradTileSize || south < 0 || north >= nexradTileSize {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	nexradMutex.Unlock()
+
+	// Coarse (high scale factor) blocks first, so that finer ones are drawn over them. Older blocks before newer.
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].block.Scale != blocks[j].block.Scale {
+			return blocks[i].block.Scale > blocks[j].block.Scale
+		}
+		return blocks[i].received.Before(blocks[j].received)
+	})
+
+	for _, b := range blocks {
+		binWidth := b.block.Width / nexradBinColumns
+		binHeight := b.block.Height / nexradBinRows
+		for i, v := range b.block.Intensity {
+			if i >= nexradBinColumns*nexradBinRows {
+				break
+			}
+			row := i / nexradBinColumns
+			col := i % nexradBinColumns
+			if !nexradBinVisible(product, v) {
+				continue
+			}
+			lonWest := b.block.LonWest + float64(col)*binWidth
+			latNorth := b.block.LatNorth - float64(row)*binHeight
+			x0 := int(math.Floor(nexradPixelX(lonWest, z) - tileX))
+			x1 := int(math.Ceil(nexradPixelX(lonWest+binWidth, z) - tileX))
+			y0 := int(math.Floor(nexradPixelY(latNorth, z) - tileY))
+			y1 := int(math.Ceil(nexradPixelY(latNorth-binHeight, z) - tileY))
+			r := image.Rect(x0, y0, x1, y1).Intersect(img.Bounds())
+			for py := r.Min.Y; py < r.Max.Y; py++ {
+				for px := r.Min.X; px < r.Max.X; px++ {
+					img.SetNRGBA(px, py, nexradColors[v])
+				}
+			}
+		}
+	}
+	return img
+}
+
+func handleNEXRADStatusRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	summaryJSON, _ := json.Marshal(getNEXRADSummary())
+	fmt.Fprintf(w, "%s\n", summaryJSON)
+}
+
+// handleNEXRADRequest serves /nexrad/status and /nexrad/{regional,conus}/z/x/y.png.
+func handleNEXRADRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/nexrad/")
+	if path == "status" {
+		handleNEXRADStatusRequest(w, r)
+		return
+	}
+
+	var name string
+	var z uint
+	var x, y int
+	if n, err := fmt.Sscanf(strings.Replace(path, "/", " ", -1), "%s %d %d %d.png", &name, &z, &x, &y); err != nil || n != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	var product uint32
+	switch name {
+	case "regional":
+		product = NEXRAD_REGIONAL
+	case "conus":
+		product = NEXRAD_CONUS
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if z > nexradMaxZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderNEXRADTile(product, z, x, y)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setNoCache(w)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// nexradWatcher drops blocks that haven't been retransmitted within nexradMaxAge.
+func nexradWatcher() {
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		<-ticker.C
+		nexradMutex.Lock()
+		for product, grid := range nexradGrids {
+			for k, b := range grid.blocks {
+				if stratuxClock.Since(b.received) > nexradMaxAge[product] {
+					delete(grid.blocks, k)
+				}
+			}
+		}
+		nexradMutex.Unlock()
+	}
+}
+
+func initNEXRAD() {
+	nexradMutex = &sync.Mutex{}
+	nexradGrids = make(map[uint32]*nexradGrid)
+	for _, product := range []uint32{NEXRAD_REGIONAL, NEXRAD_CONUS} {
+		nexradGrids[product] = &nexradGrid{blocks: make(map[nexradBlockKey]*nexradBlock)}
+	}
+	go nexradWatcher()
+}
@@ -0,0 +1,239 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ownship.go: Ownship ICAO address detection by correlating traffic targets with GPS/baro ownship data.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	ownshipMinGroundSpeed   = 30   // Only correlate when ownship is moving, knots. Parked aircraft next to us would otherwise look like ownship.
+	ownshipMaxDistance      = 250  // Horizontal tolerance, meters. Increased by distance travelled since the target position was received.
+	ownshipMaxAltDiff       = 300  // Vertical tolerance, feet.
+	ownshipMaxTrackDiff     = 20   // Track tolerance, degrees.
+	ownshipMaxSpeedDiff     = 20   // Groundspeed tolerance, knots.
+	ownshipScoreWeight      = 0.05 // Weight of each new sample in the running score.
+	ownshipDetectScore      = 0.9  // Score needed to declare a candidate as ownship.
+	ownshipDetectMinSamples = 60   // Samples (seconds) needed to declare a candidate as ownship.
+	ownshipLostScore        = 0.5  // A detected ownship is dropped when its score falls below this.
+	ownshipMaxCandidates    = 5    // Number of candidates shown in status.
+	ownshipMaxPositionAge   = 3    // Cap on the target position age allowed for in the horizontal tolerance, seconds.
+	ownshipGhostMinTime     = 5    // A TIS-B/ADS-R target must correlate for this long before it is suppressed as a ghost, seconds.
+	ownshipGDL90InputTime   = 10   // The ownship address from GDL90 input is used for this long after the last ownship report, seconds.
+)
+
+type OwnshipCandidate struct {
+	Icao_addr string  // ICAO address, hex.
+	Score     float64 // Running average of correlation with ownship, 0-1.
+	Samples   uint32  // Number of samples (seconds) the target has been compared against ownship.
+}
+
+var ownshipCandidates map[uint32]OwnshipCandidate // Protected by trafficMutex.
+var ownshipDetectedCode uint32                    // Auto-detected ownship address. Zero if none has been detected. Protected by trafficMutex.
+var ownshipGhostSince map[uint32]time.Time        // stratuxClock time TIS-B/ADS-R targets started correlating with ownship. Protected by trafficMutex.
+var ownshipGDL90InputCode uint32                  // Ownship address from GDL90 input ownship reports. Zero if none has been received. Protected by trafficMutex.
+var ownshipGDL90InputLast time.Time               // stratuxClock time of the last GDL90 input ownship report. Protected by trafficMutex.
+
+// isOwnshipCodeValid returns false for the "not set" codes F0xxxx and 00xxxx.
+func isOwnshipCodeValid(code uint32) bool {
+	return (code>>16) != 0xF0 && (code>>16) != 0x00 && code <= 0xFFFFFF
+}
+
+// getOwnshipCode returns the ICAO address of ownship, from settings.OwnshipModeS if it is set,
+// from GDL90 input ownship reports if they are being received, or from auto-detection otherwise.
+func getOwnshipCode() (uint32, bool) {
+	code, err := strconv.ParseUint(globalSettings.OwnshipModeS, 16, 32)
+	if err == nil && isOwnshipCodeValid(uint32(code)) {
+		return uint32(code), true
+	}
+	if ownshipGDL90InputCode != 0 && stratuxClock.Since(ownshipGDL90InputLast) < ownshipGDL90InputTime*time.Second {
+		return ownshipGDL90InputCode, true
+	}
+	if globalSettings.OwnshipAutoDetect && ownshipDetectedCode != 0 {
+		return ownshipDetectedCode, true
+	}
+	return 0, false
+}
+
+// angleDiff returns the absolute difference between two headings, degrees.
+func angleDiff(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+// correlateWithOwnship compares the target's position, altitude, and velocity with ownship GPS and
+// baro data. Returns ok == false if there isn't enough data for a comparison, otherwise match is
+// true if the target is within tolerances of ownship.
+func correlateWithOwnship(ti TrafficInfo) (match bool, ok bool) {
+	if !ti.Position_valid || !ti.BearingDist_valid || !isGPSGroundTrackValid() {
+		return false, false
+	}
+	if ti.AgeLastAlt >= 5 || !ti.Speed_valid {
+		return false, false
+	}
+
+	// Position. Allow for the distance flown since the target position was received.
+	maxDist := ownshipMaxDistance + mySituation.GPSGroundSpeed*KNOTS_TO_MPS*math.Min(ti.Age, ownshipMaxPositionAge)
+	if ti.Distance > maxDist {
+		return false, true
+	}
+
+	// Altitude. Compare pressure altitudes if we have them, otherwise GNSS altitudes.
+	if !ti.AltIsGNSS && isTempPressValid() {
+		if math.Abs(float64(ti.Alt)-float64(mySituation.BaroPressureAltitude)) > ownshipMaxAltDiff {
+			return false, true
+		}
+	} else if ti.AltIsGNSS {
+		if math.Abs(float64(ti.Alt)-float64(mySituation.GPSAltitudeMSL)) > ownshipMaxAltDiff {
+			return false, true
+		}
+	} else if stratuxClock.Since(ti.Last_GnssDiff) < 60*time.Second {
+		// Target reports GNSS height above ellipsoid relative to pressure altitude.
+		if math.Abs(float64(ti.Alt+ti.GnssDiffFromBaroAlt)-float64(mySituation.GPSHeightAboveEllipsoid)) > ownshipMaxAltDiff {
+			return false, true
+		}
+	} else {
+		return false, false // No altitude we can compare against.
+	}
+
+	// Velocity.
+	if math.Abs(float64(ti.Speed)-mySituation.GPSGroundSpeed) > ownshipMaxSpeedDiff {
+		return false, true
+	}
+	if mySituation.GPSGroundSpeed >= ownshipMinGroundSpeed && angleDiff(float64(ti.Track), float64(mySituation.GPSTrueCourse)) > ownshipMaxTrackDiff {
+		return false, true
+	}
+
+	return true, true
+}
+
+// updateOwnshipCandidate adds a correlation sample for the target. Only targets transmitting
+// ADS-B or Mode S with an ICAO address are considered.
+// trafficMutex must be locked before calling this function.
+func updateOwnshipCandidate(ti TrafficInfo) {
+	if !globalSettings.OwnshipAutoDetect || mySituation.GPSGroundSpeed < ownshipMinGroundSpeed {
+		return
+	}
+	if ti.Addr_type != 0 || (ti.TargetType != TARGET_TYPE_ADSB && ti.TargetType != TARGET_TYPE_MODE_S) || ti.Age > 2 {
+		return
+	}
+	match, ok := correlateWithOwnship(ti)
+	if !ok {
+		return
+	}
+
+	c, exists := ownshipCandidates[ti.Icao_addr]
+	if !exists {
+		if !match {
+			return // Only start tracking targets once they have correlated at least once.
+		}
+		c.Icao_addr = fmt.Sprintf("%06X", ti.Icao_addr)
+	}
+	m := 0.0
+	if match {
+		m = 1.0
+	}
+	c.Score = (1-ownshipScoreWeight)*c.Score + ownshipScoreWeight*m
+	c.Samples++
+	ownshipCandidates[ti.Icao_addr] = c
+}
+
+// updateOwnshipDetection drops candidates that are no longer being tracked, decides if a single
+// candidate has correlated well enough to be ownship, and updates status.
+// trafficMutex must be locked before calling this function.
+func updateOwnshipDetection() {
+	for icao := range ownshipCandidates {
+		if _, ok := traffic[icao]; !ok {
+			delete(ownshipCandidates, icao)
+		}
+	}
+	for icao := range ownshipGhostSince {
+		if _, ok := traffic[icao]; !ok {
+			delete(ownshipGhostSince, icao)
+		}
+	}
+
+	// Drop the detected ownship once it stops correlating, e.g. a formation or tow partner that
+	// was flying alongside.
+	if ownshipDetectedCode != 0 {
+		if c, ok := ownshipCandidates[ownshipDetectedCode]; !ok || c.Score < ownshipLostScore || !globalSettings.OwnshipAutoDetect {
+			log.Printf("ownship detection cleared: %06X\n", ownshipDetectedCode)
+			ownshipDetectedCode = 0
+		}
+	}
+
+	candidates := make([]OwnshipCandidate, 0, len(ownshipCandidates))
+	var best uint32
+	for icao, c := range ownshipCandidates {
+		candidates = append(candidates, c)
+		if best == 0 || c.Score > ownshipCandidates[best].Score {
+			best = icao
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	// Declare the best candidate as ownship only if it is a clear winner.
+	if best != 0 && best != ownshipDetectedCode {
+		c := ownshipCandidates[best]
+		if c.Score >= ownshipDetectScore && c.Samples >= ownshipDetectMinSamples && (len(candidates) < 2 || candidates[1].Score < 0.5) {
+			log.Printf("ownship detected: %06X (score %.2f over %d samples)\n", best, c.Score, c.Samples)
+			ownshipDetectedCode = best
+			if globalSettings.OwnshipAutoPersist {
+				if code, err := strconv.ParseUint(globalSettings.OwnshipModeS, 16, 32); err != nil || !isOwnshipCodeValid(uint32(code)) {
+					globalSettings.OwnshipModeS = fmt.Sprintf("%06X", best)
+					saveSettings()
+				}
+			}
+		}
+	}
+
+	if len(candidates) > ownshipMaxCandidates {
+		candidates = candidates[:ownshipMaxCandidates]
+	}
+	globalStatus.OwnshipCandidates = candidates
+	if ownshipDetectedCode != 0 {
+		globalStatus.OwnshipDetected = fmt.Sprintf("%06X", ownshipDetectedCode)
+	} else {
+		globalStatus.OwnshipDetected = ""
+	}
+}
+
+// isOwnshipGhost returns true if the target is a TIS-B or ADS-R track that has been colocated with
+// ownship for at least ownshipGhostMinTime, i.e. ground station rebroadcast of our own transmissions.
+// Called once per second for each target.
+// trafficMutex must be locked before calling this function.
+func isOwnshipGhost(ti TrafficInfo) bool {
+	if ti.TargetType != TARGET_TYPE_TISB && ti.TargetType != TARGET_TYPE_TISB_S && ti.TargetType != TARGET_TYPE_ADSR {
+		return false
+	}
+	if code, ok := getOwnshipCode(); ok && ti.Icao_addr == code {
+		return false // Handled as ownship.
+	}
+	if match, ok := correlateWithOwnship(ti); !ok || !match {
+		delete(ownshipGhostSince, ti.Icao_addr)
+		return false
+	}
+	since, ok := ownshipGhostSince[ti.Icao_addr]
+	if !ok {
+		since = stratuxClock.Time
+		ownshipGhostSince[ti.Icao_addr] = since
+	}
+	return stratuxClock.Since(since) >= ownshipGhostMinTime*time.Second
+}
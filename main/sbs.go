@@ -0,0 +1,223 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sbs.go: SBS-1 (BaseStation, "port 30003") TCP output of the fused traffic picture, including UAT and TIS-B targets.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SBS message types. See http://woodair.net/sbs/article/barebones42_socket_data.htm
+const (
+	SBS_MSG_IDENT    = 1 // Callsign.
+	SBS_MSG_POSITION = 3 // Airborne position.
+	SBS_MSG_VELOCITY = 4 // Groundspeed, track, vertical rate.
+	SBS_MSG_ALTITUDE = 5 // Surveillance altitude (no position).
+	SBS_MSG_SQUAWK   = 6 // Surveillance ID (squawk).
+
+	sbsIdentInterval = 10 * time.Second // Resend callsign and squawk even if unchanged, for clients that have just connected.
+)
+
+// What was last sent for each target, so that only new data is sent.
+type sbsTargetState struct {
+	lastPosition time.Time // Last_seen of the last position sent.
+	lastVelocity time.Time // Last_speed of the last velocity sent.
+	lastAlt      time.Time // Last_alt of the last altitude sent.
+	lastIdent    time.Time // stratuxClock time the callsign and squawk were last sent.
+	tail         string
+	squawk       int
+}
+
+var sbsTargets map[uint32]sbsTargetState // Protected by trafficMutex.
+var sbsClients map[string]net.Conn
+var sbsMutex *sync.Mutex // Protects sbsClients.
+var sbsOutputChan chan []byte
+
+func sbsBool(b bool) string {
+	if b {
+		return "-1"
+	}
+	return "0"
+}
+
+// makeSBSMessage formats one SBS message. Fields not used by a message type are left empty, as
+// BaseStation does.
+func makeSBSMessage(msgType int, ti TrafficInfo, t time.Time) string {
+	hexIdent := fmt.Sprintf("%06X", ti.Icao_addr)
+	if ti.Addr_type != 0 && ti.Addr_type != 2 && ti.Addr_type != 6 {
+		hexIdent = "~" + hexIdent // Not an ICAO address (TIS-B track file, self-assigned).
+	}
+	date := t.Format("2006/01/02")
+	tm := t.Format("15:04:05.000")
+
+	var callsign, alt, gs, trk, lat, lng, vr, squawk, alert, emerg, spi, gnd string
+	switch msgType {
+	case SBS_MSG_IDENT:
+		callsign = ti.Tail
+	case SBS_MSG_POSITION:
+		alt = strconv.Itoa(int(ti.Alt))
+		lat = strconv.FormatFloat(float64(ti.Lat), 'f', 5, 32)
+		lng = strconv.FormatFloat(float64(ti.Lng), 'f', 5, 32)
+		alert, emerg, spi, gnd = sbsBool(ti.TrafficAlert), sbsBool(ti.PriorityStatus != 0), "0", sbsBool(ti.OnGround)
+	case SBS_MSG_VELOCITY:
+		gs = strconv.Itoa(int(ti.Speed))
+		trk = strconv.Itoa(int(ti.Track))
+		vr = strconv.Itoa(int(ti.Vvel))
+	case SBS_MSG_ALTITUDE:
+		alt = strconv.Itoa(int(ti.Alt))
+		alert, spi, gnd = sbsBool(ti.TrafficAlert), "0", sbsBool(ti.OnGround)
+	case SBS_MSG_SQUAWK:
+		alt = strconv.Itoa(int(ti.Alt))
+		squawk = fmt.Sprintf("%04d", ti.Squawk)
+		alert, emerg, spi, gnd = sbsBool(ti.TrafficAlert), sbsBool(ti.PriorityStatus != 0), "0", sbsBool(ti.OnGround)
+	}
+
+	return fmt.Sprintf("MSG,%d,1,1,%s,1,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s\r\n",
+		msgType, hexIdent, date, tm, date, tm, callsign, alt, gs, trk, lat, lng, vr, squawk, alert, emerg, spi, gnd)
+}
+
+// sendSBSUpdates generates SBS messages for new data in the traffic table and queues them for
+// connected SBS clients. Duplicate tracks, ownship, and ownship ghosts are not sent.
+// trafficMutex must be locked before calling this function.
+func sendSBSUpdates() {
+	if !globalSettings.SBSOutputEnabled {
+		return
+	}
+
+	now := time.Now().UTC()
+	code, codeValid := getOwnshipCode()
+	var buf bytes.Buffer
+	for icao, ti := range traffic {
+		if ti.DuplicateOf != 0 || ti.OwnshipGhost || (codeValid && icao == code) {
+			continue
+		}
+		ti = withMergedIdentity(ti)
+		st := sbsTargets[icao]
+		if len(ti.Tail) > 0 && (ti.Tail != st.tail || stratuxClock.Since(st.lastIdent) >= sbsIdentInterval) {
+			buf.WriteString(makeSBSMessage(SBS_MSG_IDENT, ti, now))
+		}
+		if ti.Squawk != 0 && (ti.Squawk != st.squawk || stratuxClock.Since(st.lastIdent) >= sbsIdentInterval) {
+			buf.WriteString(makeSBSMessage(SBS_MSG_SQUAWK, ti, now))
+		}
+		if ti.Tail != st.tail || ti.Squawk != st.squawk || stratuxClock.Since(st.lastIdent) >= sbsIdentInterval {
+			st.tail = ti.Tail
+			st.squawk = ti.Squawk
+			st.lastIdent = stratuxClock.Time
+		}
+		if ti.Position_valid && ti.Last_seen.After(st.lastPosition) {
+			buf.WriteString(makeSBSMessage(SBS_MSG_POSITION, ti, now))
+			st.lastPosition = ti.Last_seen
+			st.lastAlt = ti.Last_alt
+		} else if !ti.Position_valid && ti.Last_alt.After(st.lastAlt) {
+			// Mode S targets without position.
+			buf.WriteString(makeSBSMessage(SBS_MSG_ALTITUDE, ti, now))
+			st.lastAlt = ti.Last_alt
+		}
+		if ti.Speed_valid && ti.Last_speed.After(st.lastVelocity) {
+			buf.WriteString(makeSBSMessage(SBS_MSG_VELOCITY, ti, now))
+			st.lastVelocity = ti.Last_speed
+		}
+		sbsTargets[icao] = st
+	}
+	for icao := range sbsTargets {
+		if _, ok := traffic[icao]; !ok {
+			delete(sbsTargets, icao)
+		}
+	}
+
+	if buf.Len() > 0 {
+		select {
+		case sbsOutputChan <- buf.Bytes():
+		default:
+			log.Printf("SBS output channel full, dropping update.\n")
+		}
+	}
+}
+
+// sbsOutputWriter sends queued SBS messages to all connected clients. Clients that can't keep up
+// are disconnected.
+func sbsOutputWriter() {
+	for {
+		b := <-sbsOutputChan
+		sbsMutex.Lock()
+		for addr, conn := range sbsClients {
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write(b); err != nil {
+				log.Printf("SBS client %s disconnected: %s\n", addr, err.Error())
+				conn.Close()
+				delete(sbsClients, addr)
+			}
+		}
+		sbsMutex.Unlock()
+	}
+}
+
+func sbsAccept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // Listener was closed.
+		}
+		log.Printf("SBS client connected: %s\n", conn.RemoteAddr().String())
+		sbsMutex.Lock()
+		sbsClients[conn.RemoteAddr().String()] = conn
+		sbsMutex.Unlock()
+	}
+}
+
+// sbsOutputWatcher starts and stops the SBS listener as settings change.
+func sbsOutputWatcher() {
+	var ln net.Listener
+	var lnPort int
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		wantPort := 0
+		if globalSettings.SBSOutputEnabled {
+			wantPort = globalSettings.SBSOutputPort
+		}
+		if ln != nil && wantPort != lnPort {
+			log.Printf("closing SBS output on port %d.\n", lnPort)
+			ln.Close()
+			ln = nil
+			sbsMutex.Lock()
+			for addr, conn := range sbsClients {
+				conn.Close()
+				delete(sbsClients, addr)
+			}
+			sbsMutex.Unlock()
+		}
+		if ln == nil && wantPort != 0 {
+			var err error
+			ln, err = net.Listen("tcp", ":"+strconv.Itoa(wantPort))
+			if err != nil {
+				addSingleSystemErrorf("sbs-listen", "Can't start SBS output on port %d: %s", wantPort, err.Error())
+			} else {
+				log.Printf("SBS output listening on port %d.\n", wantPort)
+				lnPort = wantPort
+				go sbsAccept(ln)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func initSBSOutput() {
+	sbsTargets = make(map[uint32]sbsTargetState)
+	sbsClients = make(map[string]net.Conn)
+	sbsMutex = &sync.Mutex{}
+	sbsOutputChan = make(chan []byte, 16)
+	go sbsOutputWriter()
+	go sbsOutputWatcher()
+}
@@ -17,10 +17,12 @@ import (
 	"log"
 	"math"
 	"net"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"../gdl90"
 )
 
 //-0b2b48fe3aef1f88621a0856110a31c01105c4e6c4e6c40a9a820300000000000000;rs=7;
@@ -63,6 +65,7 @@ AUXSV:
 const (
 	TRAFFIC_SOURCE_1090ES = 1
 	TRAFFIC_SOURCE_UAT    = 2
+	TRAFFIC_SOURCE_GDL90  = 3 // Received as GDL90 from another receiver. See gdl90input.go.
 	TARGET_TYPE_MODE_S    = 0
 	TARGET_TYPE_ADSB      = 1
 	TARGET_TYPE_ADSR      = 2
@@ -98,6 +101,7 @@ type TrafficInfo struct {
 	Vvel                int16     // feet per minute
 	Timestamp           time.Time // timestamp of traffic message, UTC
 	PriorityStatus      uint8     // Emergency or priority code as defined in GDL90 spec, DO-260B (Type 28 msg) and DO-282B
+	NumMessages         uint32    // Number of messages received from this target.
 
 	// Parameters starting at 'Age' are calculated from last message receipt on each call of sendTrafficUpdates().
 	// Mode S transmits position and track in separate messages, and altitude can also be
@@ -110,10 +114,19 @@ type TrafficInfo struct {
 	Last_GnssDiffAlt     int32     // Altitude at last GnssDiffFromBaroAlt update.
 	Last_speed           time.Time // Time of last velocity and track update (stratuxClock).
 	Last_source          uint8     // Last frequency on which this target was received.
-	ExtrapolatedPosition bool      //TODO: True if Stratux is "coasting" the target from last known position.
+	ExtrapolatedPosition bool      // True if Stratux is "coasting" the target from last known position.
 	BearingDist_valid    bool      // set when bearing and distance information is valid
 	Bearing              float64   // Bearing in degrees true to traffic from ownship, if it can be calculated. Units: degrees.
 	Distance             float64   // Distance to traffic from ownship, if it can be calculated. Units: meters.
+	CPA_valid            bool      // set when closest point of approach could be calculated.
+	CPA_time             float64   // Time to closest point of approach. 0 if target is diverging. Units: seconds.
+	CPA_distance         float64   // Horizontal distance between ownship and traffic at closest point of approach. Units: meters.
+	CPA_alt              int32     // Altitude of traffic relative to ownship at closest point of approach, positive above. Units: feet.
+	TrafficAlert         bool      // set when the closest point of approach is within the alert thresholds.
+	OwnshipGhost         bool      // set when a TIS-B or ADS-R target is a rebroadcast of ownship. Not sent to the EFB.
+	DuplicateOf          uint32    // Icao_addr of the preferred track if this target is a duplicate track of the same aircraft. Not sent to the EFB.
+	Merged_addr          uint32    // Icao_addr of a duplicate track merged into this target.
+	Merged_source        uint8     // Last_source of the duplicate track merged into this target. This target's own Last_source and TargetType won.
 	//FIXME: Rename variables for consistency, especially "Last_".
 }
 
@@ -167,25 +180,28 @@ func sendTrafficUpdates() {
 	defer trafficMutex.Unlock()
 	cleanupOldEntries()
 
-	// Summarize number of UAT and 1090ES traffic targets for reports that follow.
+	// Summarize number of UAT, 1090ES, and GDL90 input traffic targets for reports that follow.
 	globalStatus.UAT_traffic_targets_tracking = 0
 	globalStatus.ES_traffic_targets_tracking = 0
+	globalStatus.GDL90Input_traffic_targets_tracking = 0
 	for _, traf := range traffic {
 		switch traf.Last_source {
 		case TRAFFIC_SOURCE_1090ES:
 			globalStatus.ES_traffic_targets_tracking++
 		case TRAFFIC_SOURCE_UAT:
 			globalStatus.UAT_traffic_targets_tracking++
+		case TRAFFIC_SOURCE_GDL90:
+			globalStatus.GDL90Input_traffic_targets_tracking++
 		}
 	}
 
-	msgs := make([][]byte, 1)
+	targets := make([]TrafficInfo, 0)
 	if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
 		log.Printf("List of all aircraft being tracked:\n")
 		log.Printf("==================================================================\n")
 	}
-	code, _ := strconv.ParseInt(globalSettings.OwnshipModeS, 16, 32)
-	for icao, ti := range traffic { // ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Practical limit likely around ~500 aircraft without filtering.
+	// Update age and position relative to ownship for all targets.
+	for icao, ti := range traffic {
 		if isGPSValid() {
 			// func distRect(lat1, lon1, lat2, lon2 float64) (dist, bearing, distN, distE float64) {
 			dist, bearing := distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
@@ -199,7 +215,16 @@ func sendTrafficUpdates() {
 		}
 		ti.Age = stratuxClock.Since(ti.Last_seen).Seconds()
 		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
+		ti = computeCPA(ti)
+		ti.OwnshipGhost = isOwnshipGhost(ti)
+		traffic[icao] = ti // write the updated ti back to the map
+		updateOwnshipCandidate(ti)
+	}
+	updateOwnshipDetection()
+	fuseDuplicateTargets()
 
+	code, codeValid := getOwnshipCode()
+	for _, ti := range traffic { // ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Practical limit likely around ~500 aircraft without filtering.
 		// DEBUG: Print the list of all tracked targets (with data) to the log every 15 seconds if "DEBUG" option is enabled
 		if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
 			s_out, err := json.Marshal(ti)
@@ -210,176 +235,353 @@ func sendTrafficUpdates() {
 			}
 			// end of debug block
 		}
-		traffic[icao] = ti // write the updated ti back to the map
 		//log.Printf("Traffic age of %X is %f seconds\n",icao,ti.Age)
 		if ti.Age > 2 { // if nothing polls an inactive ti, it won't push to the webUI, and its Age won't update.
 			trafficUpdate.SendJSON(ti)
 		}
-		if ti.Position_valid && ti.Age < 6 { // ... but don't pass stale data to the EFB.
-			//TODO: Coast old traffic? Need to determine how FF, WingX, etc deal with stale targets.
+		if ti.Position_valid && ti.Age < 6 {
 			logTraffic(ti) // only add to the SQLite log if it's not stale
+		}
+		if ti.Position_valid && ti.Age < trafficMaxAge(ti) { // ... but don't pass stale data to the EFB.
+			if ti.Age > 2 && isTrafficCoastable(ti) {
+				// Coast the target from its last known position so it doesn't blink out of the EFB between reports.
+				ti = coastTraffic(ti)
+			}
 
-			if ti.Icao_addr == uint32(code) {
+			if codeValid && ti.Icao_addr == code {
 				if globalSettings.DEBUG {
 					log.Printf("Ownship target detected for code %X\n", code)
 				}
 				OwnshipTrafficInfo = ti
-			} else {
-				cur_n := len(msgs) - 1
-				if len(msgs[cur_n]) >= 35 {
-					// Batch messages into packets with at most 35 traffic reports
-					//  to keep each packet under 1KB.
-					cur_n++
-					msgs = append(msgs, make([]byte, 0))
+			} else if ti.OwnshipGhost {
+				if globalSettings.DEBUG {
+					log.Printf("Suppressing ownship ghost %X\n", ti.Icao_addr)
 				}
-				msgs[cur_n] = append(msgs[cur_n], makeTrafficReportMsg(ti)...)
+			} else if ti.DuplicateOf != 0 {
+				// Merged into another track, which is sent instead.
+			} else {
+				targets = append(targets, withMergedIdentity(ti))
 			}
 		}
 	}
 
-	for i := 0; i < len(msgs); i++ {
-		msg := msgs[i]
-		if len(msg) > 0 {
-			sendGDL90(msg, false)
-		}
+	checkTrafficAlerts()
+	sendSBSUpdates()
+	sendTrafficReports(targets)
+	sendFLARMUpdates(targets)
+}
+
+// isPreferredTarget returns true if target a should be kept over target b when they are duplicate
+// tracks of the same aircraft. Prefer better position accuracy and integrity, then fresher data.
+func isPreferredTarget(a, b TrafficInfo) bool {
+	if a.NACp != b.NACp {
+		return a.NACp > b.NACp
+	}
+	if a.NIC != b.NIC {
+		return a.NIC > b.NIC
 	}
+	if math.Abs(a.Age-b.Age) > 0.5 {
+		return a.Age < b.Age
+	}
+	if a.TargetType != b.TargetType {
+		return a.TargetType < b.TargetType // Direct ADS-B over rebroadcasts.
+	}
+	return a.Icao_addr < b.Icao_addr
 }
 
-// Send update to attached JSON client.
-func registerTrafficUpdate(ti TrafficInfo) {
-	//logTraffic(ti) // moved to sendTrafficUpdates() to reduce SQLite log size
-	/*
-		if !ti.Position_valid { // Don't send unless a valid position exists.
-			return
+// isDuplicateTarget returns true if targets a and b are likely different tracks of the same
+// aircraft - e.g. ADS-B on 1090ES and TIS-B on UAT.
+func isDuplicateTarget(a, b TrafficInfo) bool {
+	if a.Addr_type == 0 && b.Addr_type == 0 {
+		return false // Two different ICAO addresses are two different aircraft.
+	}
+	if !a.Position_valid || !b.Position_valid || a.Age > 6 || b.Age > 6 {
+		return false
+	}
+	// Allow for movement between the two position reports.
+	maxDist := 300 + float64(iMax(int(a.Speed), int(b.Speed)))*KNOTS_TO_MPS*math.Abs(a.Age-b.Age)
+	if math.Abs(float64(a.Lat-b.Lat)) > 0.1 || math.Abs(float64(a.Lng-b.Lng)) > 0.1 {
+		return false // Quick reject.
+	}
+	if dist, _, _, _ := distRect(float64(a.Lat), float64(a.Lng), float64(b.Lat), float64(b.Lng)); dist > maxDist {
+		return false
+	}
+	if a.AgeLastAlt > 10 || b.AgeLastAlt > 10 || a.AltIsGNSS != b.AltIsGNSS || math.Abs(float64(a.Alt-b.Alt)) > 200 {
+		return false
+	}
+	if a.Speed_valid && b.Speed_valid {
+		if math.Abs(float64(a.Speed)-float64(b.Speed)) > 30 {
+			return false
 		}
-	*/ // Send all traffic to the websocket and let JS sort it out. This will provide user indication of why they see 1000 ES messages and no traffic.
-	trafficUpdate.SendJSON(ti)
+		if a.Speed > 30 && b.Speed > 30 && angleDiff(float64(a.Track), float64(b.Track)) > 30 {
+			return false
+		}
+	}
+	return true
 }
 
-func isTrafficAlertable(ti TrafficInfo) bool {
-	// Set alert bit if possible and traffic is within some threshold
-	// TODO: Could be more intelligent, taking into account headings etc.
-	if !ti.BearingDist_valid {
-		// If not able to calculate the distance to the target, let the alert bit be set always.
-		return true
+// fuseDuplicateTargets finds duplicate tracks of the same aircraft received from different sources
+// or with different address qualifiers. The preferred track is marked with Merged_addr and
+// Merged_source of the duplicate and is sent to the EFB in place of the duplicate, which is
+// marked with DuplicateOf. Targets are compared in address order so that the merges don't depend
+// on map iteration order.
+// trafficMutex must be locked before calling this function.
+func fuseDuplicateTargets() {
+	var addrs, nonICAO []uint32 // Targets that may be duplicates, and the subset that aren't ICAO addressed.
+	for icao, ti := range traffic {
+		ti.DuplicateOf = 0
+		ti.Merged_addr = 0
+		ti.Merged_source = 0
+		traffic[icao] = ti
+		if !ti.Position_valid || ti.Age > 6 {
+			continue
+		}
+		addrs = append(addrs, icao)
+		if ti.Addr_type != 0 {
+			nonICAO = append(nonICAO, icao)
+		}
 	}
-	if ti.BearingDist_valid &&
-		ti.Distance < 3704 { // 3704 meters, 2 nm.
-		return true
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	sort.Slice(nonICAO, func(i, j int) bool { return nonICAO[i] < nonICAO[j] })
+
+	// Two ICAO addressed targets are never duplicates, so only the non-ICAO targets need to be
+	// compared against the rest.
+	compared := make(map[uint32]bool) // Non-ICAO targets already compared against every other target.
+	duplicates := make(map[uint32]bool)
+	for _, addrA := range nonICAO {
+		compared[addrA] = true
+		for _, addrB := range addrs {
+			if duplicates[addrA] {
+				break
+			}
+			if addrA == addrB || compared[addrB] || duplicates[addrB] {
+				continue
+			}
+			a, b := traffic[addrA], traffic[addrB]
+			if !isDuplicateTarget(a, b) {
+				continue
+			}
+			winner, loser := a, b
+			if !isPreferredTarget(a, b) {
+				winner, loser = b, a
+			}
+			loser.DuplicateOf = winner.Icao_addr
+			winner.Merged_addr = loser.Icao_addr
+			winner.Merged_source = loser.Last_source
+			if globalSettings.DEBUG {
+				log.Printf("Merged duplicate target %X (source %d, type %d) into %X (source %d, type %d)\n",
+					loser.Icao_addr, loser.Last_source, loser.TargetType, winner.Icao_addr, winner.Last_source, winner.TargetType)
+			}
+			traffic[winner.Icao_addr] = winner
+			traffic[loser.Icao_addr] = loser
+			duplicates[loser.Icao_addr] = true
+		}
 	}
+}
 
-	return false
+// withMergedIdentity returns a copy of the target with identity information it is missing filled
+// in from the duplicate track merged into it. The traffic map isn't modified, so the identity
+// doesn't stick to the target once the tracks are no longer merged.
+// trafficMutex must be locked before calling this function.
+func withMergedIdentity(ti TrafficInfo) TrafficInfo {
+	dup, ok := traffic[ti.Merged_addr]
+	if ti.Merged_addr == 0 || !ok {
+		return ti
+	}
+	if len(ti.Tail) == 0 {
+		ti.Tail = dup.Tail
+	}
+	if len(ti.Reg) == 0 {
+		ti.Reg = dup.Reg
+	}
+	if ti.Squawk == 0 {
+		ti.Squawk = dup.Squawk
+	}
+	if ti.Emitter_category == 0 {
+		ti.Emitter_category = dup.Emitter_category
+	}
+	return ti
 }
 
-func makeTrafficReportMsg(ti TrafficInfo) []byte {
-	msg := make([]byte, 28)
-	// See p.16.
-	msg[0] = 0x14 // Message type "Traffic Report".
+// makeTrafficReportPackets encodes GDL90 traffic reports for a list of targets, batched into
+// packets with at most 35 traffic reports to keep each packet under 1KB.
+func makeTrafficReportPackets(targets []TrafficInfo) [][]byte {
+	msgs := make([][]byte, 0)
+	for i, ti := range targets {
+		if i%35 == 0 {
+			msgs = append(msgs, make([]byte, 0))
+		}
+		cur_n := len(msgs) - 1
+		msgs[cur_n] = append(msgs[cur_n], makeTrafficReportMsg(ti)...)
+	}
+	return msgs
+}
 
-	// Address type
-	msg[1] = ti.Addr_type
+// trafficFilter limits the traffic sent to a network client. Zero values disable each limit.
+type trafficFilter struct {
+	MaxRange     float64 // Maximum horizontal distance from ownship, nm.
+	MaxAltAbove  int     // Maximum altitude above ownship, feet.
+	MaxAltBelow  int     // Maximum altitude below ownship, feet.
+	HideOnGround bool    // Don't send targets reporting on-ground status.
+	MaxTargets   int     // Maximum number of targets sent. Alerted traffic is kept first, then the nearest targets.
+}
 
-	// Set alert if needed
-	if isTrafficAlertable(ti) {
-		// Set the alert bit.  See pg. 18 of GDL90 ICD
-		msg[1] |= 0x10
+// filterTraffic returns the targets that pass filter f. Targets without a known distance or altitude
+// relative to ownship are never filtered out by range or altitude band.
+func filterTraffic(targets []TrafficInfo, f trafficFilter) []TrafficInfo {
+	if f == (trafficFilter{}) {
+		return targets
+	}
+	ret := make([]TrafficInfo, 0, len(targets))
+	for _, ti := range targets {
+		if f.HideOnGround && ti.OnGround {
+			continue
+		}
+		if f.MaxRange > 0 && ti.BearingDist_valid && ti.Distance > f.MaxRange*NM_TO_METERS {
+			continue
+		}
+		if (f.MaxAltAbove > 0 || f.MaxAltBelow > 0) && isGPSValid() && ti.AgeLastAlt < 60 {
+			ownAlt, _ := ownshipAltitude(ti)
+			relAlt := float64(ti.Alt) - ownAlt
+			if f.MaxAltAbove > 0 && relAlt > float64(f.MaxAltAbove) {
+				continue
+			}
+			if f.MaxAltBelow > 0 && -relAlt > float64(f.MaxAltBelow) {
+				continue
+			}
+		}
+		ret = append(ret, ti)
 	}
 
-	// ICAO Address.
-	msg[2] = byte((ti.Icao_addr & 0x00FF0000) >> 16)
-	msg[3] = byte((ti.Icao_addr & 0x0000FF00) >> 8)
-	msg[4] = byte((ti.Icao_addr & 0x000000FF))
-
-	lat := float32(ti.Lat)
-	tmp := makeLatLng(lat)
-
-	msg[5] = tmp[0] // Latitude.
-	msg[6] = tmp[1] // Latitude.
-	msg[7] = tmp[2] // Latitude.
-
-	lng := float32(ti.Lng)
-	tmp = makeLatLng(lng)
-
-	msg[8] = tmp[0]  // Longitude.
-	msg[9] = tmp[1]  // Longitude.
-	msg[10] = tmp[2] // Longitude.
-
-	// Altitude: OK
-	// GDL 90 Data Interface Specification examples:
-	// where 1,000 foot offset and 25 foot resolution (1,000 / 25 = 40)
-	//    -1,000 feet               0x000
-	//    0 feet                    0x028
-	//    +1000 feet                0x050
-	//    +101,350 feet             0xFFE
-	//    Invalid or unavailable    0xFFF
-	//
-	// Algo example at: https://play.golang.org/p/VXCckSdsvT
-	//
-	var alt int16
-	if ti.Alt < -1000 || ti.Alt > 101350 {
-		alt = 0x0FFF
-	} else {
-		// output guaranteed to be between 0x0000 and 0x0FFE
-		alt = int16((ti.Alt / 25) + 40)
+	if f.MaxTargets > 0 && len(ret) > f.MaxTargets {
+		sort.SliceStable(ret, func(i, j int) bool {
+			if ret[i].TrafficAlert != ret[j].TrafficAlert {
+				return ret[i].TrafficAlert
+			}
+			if ret[i].BearingDist_valid != ret[j].BearingDist_valid {
+				return ret[i].BearingDist_valid
+			}
+			return ret[i].Distance < ret[j].Distance
+		})
+		ret = ret[:f.MaxTargets]
 	}
-	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
-	msg[12] = byte((alt & 0x00F) << 4)
-
-	// "m" field. Lower four bits define indicator bits:
-	// - - 0 0   "tt" (msg[17]) is not valid
-	// - - 0 1   "tt" is true track
-	// - - 1 0   "tt" is magnetic heading
-	// - - 1 1   "tt" is true heading
-	// - 0 - -   Report is updated (current data)
-	// - 1 - -   Report is extrapolated
-	// 0 - - -   On ground
-	// 1 - - -   Airborne
-
-	// Define tt type / validity
-	if ti.Speed_valid {
-		msg[12] = msg[12] | 0x01 // assume true track
+	return ret
+}
+
+// sendTrafficReports queues traffic reports for all targets. Filtering for each client is done
+// in sendToAllConnectedClients().
+func sendTrafficReports(targets []TrafficInfo) {
+	if len(targets) == 0 {
+		return
 	}
+	messageQueue <- networkMessage{msgType: NETWORK_GDL90_STANDARD, queueable: false, ts: stratuxClock.Time, traffic: targets}
+}
+
+// isTrafficCoastable returns true if there is enough information to extrapolate the position of a target.
+func isTrafficCoastable(ti TrafficInfo) bool {
+	return globalSettings.TrafficMaxCoastTime > 0 && ti.Speed_valid
+}
 
-	if ti.ExtrapolatedPosition {
-		msg[12] = msg[12] | 0x04
+// trafficMaxAge returns the age (seconds) after which a target is no longer sent to the EFB.
+func trafficMaxAge(ti TrafficInfo) float64 {
+	if isTrafficCoastable(ti) && globalSettings.TrafficMaxCoastTime > 6 {
+		return float64(globalSettings.TrafficMaxCoastTime)
 	}
+	return 6
+}
+
+// coastTraffic returns a copy of ti with position and altitude dead-reckoned from the last reported
+// track, speed, and vertical velocity. The stored target is not modified, so extrapolation errors
+// don't accumulate between updates.
+func coastTraffic(ti TrafficInfo) TrafficInfo {
+	radius_earth := 6371008.8 // meters; mean radius
 
-	if !ti.OnGround {
-		msg[12] = msg[12] | 0x08 // Airborne.
+	dist := float64(ti.Speed) * KNOTS_TO_MPS * ti.Age // meters travelled since last position.
+	distN := dist * math.Cos(radians(float64(ti.Track)))
+	distE := dist * math.Sin(radians(float64(ti.Track)))
+
+	lat := float64(ti.Lat) + degrees(distN/radius_earth)
+	lng := float64(ti.Lng) + degrees(distE/(radius_earth*math.Cos(radians(float64(ti.Lat)))))
+	if lat > 90 || lat < -90 {
+		return ti // Don't try to coast over the poles.
+	}
+	if lng > 180 {
+		lng -= 360
+	} else if lng < -180 {
+		lng += 360
 	}
+	ti.Lat = float32(lat)
+	ti.Lng = float32(lng)
 
-	// Position containment / navigational accuracy
-	msg[13] = ((byte(ti.NIC) << 4) & 0xF0) | (byte(ti.NACp) & 0x0F)
+	if ti.Vvel != 0 && ti.AgeLastAlt < 60 {
+		ti.Alt += int32(float64(ti.Vvel) * ti.AgeLastAlt / 60.0)
+	}
 
-	// Horizontal velocity (speed).
+	if isGPSValid() {
+		ti.Distance, ti.Bearing = distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	}
+	ti.ExtrapolatedPosition = true
+	return ti
+}
 
-	msg[14] = byte((ti.Speed & 0x0FF0) >> 4)
-	msg[15] = byte((ti.Speed & 0x000F) << 4)
+// Send update to attached JSON client.
+func registerTrafficUpdate(ti TrafficInfo) {
+	//logTraffic(ti) // moved to sendTrafficUpdates() to reduce SQLite log size
+	/*
+		if !ti.Position_valid { // Don't send unless a valid position exists.
+			return
+		}
+	*/ // Send all traffic to the websocket and let JS sort it out. This will provide user indication of why they see 1000 ES messages and no traffic.
+	trafficUpdate.SendJSON(ti)
+	mqttPublishTraffic(ti)
+}
 
-	// Vertical velocity.
-	vvel := ti.Vvel / 64 // 64fpm resolution.
-	msg[15] = msg[15] | byte((vvel&0x0F00)>>8)
-	msg[16] = byte(vvel & 0x00FF)
+// isTrafficAlertable returns true if the GDL90 traffic alert bit should be set for the target.
+// See computeCPA() for the alert criteria.
+func isTrafficAlertable(ti TrafficInfo) bool {
+	return ti.CPA_valid && ti.TrafficAlert
+}
 
-	// Track.
-	trk := uint8(float32(ti.Track) / TRACK_RESOLUTION) // Resolution is ~1.4 degrees.
-	msg[17] = byte(trk)
+func makeTrafficReportMsg(ti TrafficInfo) []byte {
+	// See p.16.
+	r := gdl90.TrafficReport{
+		Alert:        isTrafficAlertable(ti), // See pg. 18 of GDL90 ICD
+		AddrType:     ti.Addr_type,
+		Address:      ti.Icao_addr,
+		Lat:          ti.Lat,
+		Lng:          ti.Lng,
+		AltValid:     true, // Encoded as invalid (0xFFF) if out of range.
+		Alt:          ti.Alt,
+		Extrapolated: ti.ExtrapolatedPosition,
+		Airborne:     !ti.OnGround,
+		NIC:          uint8(ti.NIC),
+		NACp:         uint8(ti.NACp),
+		SpeedValid:   true,
+		Speed:        ti.Speed,
+		VvelValid:    true,
+		Vvel:         ti.Vvel,
+		Track:        float32(ti.Track),
+		Emitter:      ti.Emitter_category,
+		Priority:     ti.PriorityStatus, // Priority / emergency status per GDL90 spec (DO260B and DO282B are same codes)
+	}
 
-	msg[18] = ti.Emitter_category
+	if ti.Speed_valid {
+		r.TrackType = gdl90.TRACK_TYPE_TRUE_TRACK // assume true track
+	}
 
-	// msg[19] to msg[26] are "call sign" (tail).
-	for i := 0; i < len(ti.Tail) && i < 8; i++ {
-		c := byte(ti.Tail[i])
-		if c != 20 && !((c >= 48) && (c <= 57)) && !((c >= 65) && (c <= 90)) && c != 'e' && c != 'u' && c != 'a' && c != 'r' && c != 't' { // See p.24, FAA ref.
-			c = byte(20)
+	// Call sign (tail).
+	tail := []byte(ti.Tail)
+	if len(tail) > 8 {
+		tail = tail[:8]
+	}
+	for i, c := range tail {
+		if c != ' ' && !((c >= 48) && (c <= 57)) && !((c >= 65) && (c <= 90)) && c != 'e' && c != 'u' && c != 'a' && c != 'r' && c != 't' { // See p.24, FAA ref.
+			tail[i] = ' '
 		}
-		msg[19+i] = c
 	}
+	r.Callsign = string(tail)
 
-	//msg[27] is priority / emergency status per GDL90 spec (DO260B and DO282B are same codes)
-	msg[27] = ti.PriorityStatus << 4
-
-	return prepareMessage(msg)
+	return gdl90.Encode(r)
 }
 
 // parseDownlinkReport decodes a UAT downlink message to extract identity, state vector, and mode status data.
@@ -733,6 +935,8 @@ func parseDownlinkReport(s string, signalLevel int) {
 	ti.Timestamp = time.Now()
 
 	ti.Last_source = TRAFFIC_SOURCE_UAT
+	ti.NumMessages++
+	trafficMessagesTotal++
 
 	traffic[ti.Icao_addr] = ti
 	registerTrafficUpdate(ti)
@@ -1055,6 +1259,8 @@ func esListen() {
 				}
 			*/
 
+			ti.NumMessages++
+			trafficMessagesTotal++
 			traffic[ti.Icao_addr] = ti // Update information on this ICAO code.
 			registerTrafficUpdate(ti)
 			seenTraffic[ti.Icao_addr] = true // Mark as seen.
@@ -1343,5 +1549,8 @@ func initTraffic() {
 	traffic = make(map[uint32]TrafficInfo)
 	seenTraffic = make(map[uint32]bool)
 	trafficMutex = &sync.Mutex{}
+	ownshipCandidates = make(map[uint32]OwnshipCandidate)
+	ownshipGhostSince = make(map[uint32]time.Time)
+	initAlerts()
 	go esListen()
 }
@@ -0,0 +1,93 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	weathergraphics.go: Graphical AIRMETs, SIGMETs, TFRs and SUAs received over FIS-B, served as GeoJSON
+	 on /weather/graphics.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"../uatparse"
+)
+
+// Overlays not retransmitted for this long are dropped, even if their end time hasn't passed.
+const weatherGraphicsMaxAge = 60 * time.Minute
+
+// One overlay record of a report.
+type weatherGraphicKey struct {
+	productID    uint32
+	location     string
+	reportNumber uint16
+	reportYear   uint16
+	recordID     uint8
+}
+
+type weatherGraphic struct {
+	overlay  uatparse.GraphicalOverlay
+	lastSeen time.Time // stratuxClock.
+}
+
+var weatherGraphics map[weatherGraphicKey]*weatherGraphic
+var weatherGraphicsMutex *sync.Mutex
+
+// registerWeatherGraphics stores the graphical overlays decoded from an uplink frame. Only
+// AIRMETs, SIGMETs, convective SIGMETs and NOTAMs (TFRs, SUAs) are kept.
+func registerWeatherGraphics(f *uatparse.UATFrame) {
+	weatherGraphicsMutex.Lock()
+	defer weatherGraphicsMutex.Unlock()
+	for _, o := range f.Overlays {
+		switch o.ProductID {
+		case 8, 11, 12, 13:
+		default:
+			continue
+		}
+		k := weatherGraphicKey{
+			productID:    o.ProductID,
+			location:     o.LocationIdentifier,
+			reportNumber: o.ReportNumber,
+			reportYear:   o.ReportYear,
+			recordID:     o.RecordID,
+		}
+		weatherGraphics[k] = &weatherGraphic{overlay: o, lastSeen: stratuxClock.Time}
+	}
+}
+
+// getWeatherGraphics returns the overlays that are currently in effect. Expired overlays are removed.
+func getWeatherGraphics() uatparse.GeoJSONFeatureCollection {
+	weatherGraphicsMutex.Lock()
+	defer weatherGraphicsMutex.Unlock()
+	ret := uatparse.GeoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]uatparse.GeoJSONFeature, 0)}
+	now := time.Now()
+	for k, g := range weatherGraphics {
+		if stratuxClock.Since(g.lastSeen) > weatherGraphicsMaxAge || (!g.overlay.End.IsZero() && !now.Before(g.overlay.End)) {
+			delete(weatherGraphics, k)
+			continue
+		}
+		if g.overlay.Valid(now) {
+			ret.Features = append(ret.Features, g.overlay.GeoJSON())
+		}
+	}
+	return ret
+}
+
+func handleWeatherGraphicsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	graphicsJSON, _ := json.Marshal(getWeatherGraphics())
+	fmt.Fprintf(w, "%s\n", graphicsJSON)
+}
+
+func initWeatherGraphics() {
+	weatherGraphics = make(map[weatherGraphicKey]*weatherGraphic)
+	weatherGraphicsMutex = &sync.Mutex{}
+}
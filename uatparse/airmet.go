@@ -0,0 +1,451 @@
+package uatparse
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Text/graphic products - NOTAMs (including TFRs), AIRMETs, SIGMETs, SUA. Aero_FISB_ProdDef_Rev4.pdf.
+//
+// The APDU payload is a 6 byte product header followed by 'record_count' records, all in the
+// product's record format - text (1, 2) or graphical overlay (8). A report may be split across several
+// graphical records, e.g. one per altitude layer, identified by the overlay record identifier.
+//
+// Lightning points (151), storm tops and velocity (83) and the generic text, vector and symbol
+// products (402-405, 411, 412) are carried in the same product header and records. Records in any
+// other format are left undecoded.
+
+const (
+	RECORD_FORMAT_ASCII   = 1 // Unformatted ASCII text.
+	RECORD_FORMAT_TEXT    = 2 // Unformatted DLAC text.
+	RECORD_FORMAT_OVERLAY = 8 // Graphical overlay.
+
+	airmetPrismSteps = 36 // Vertices used to approximate a prism's ellipse in GeoJSON.
+)
+
+type GraphicalOverlay struct {
+	ProductID          uint32
+	LocationIdentifier string
+	ReportNumber       uint16
+	ReportYear         uint16
+	RecordID           uint8  // Overlay record identifier, 1-16.
+	ObjectLabel        string // Numeric or alphanumeric label.
+	ObjectElement      uint8
+	ObjectType         uint8
+	ObjectStatus       uint8
+	ObjectQualifier    uint32
+	ParameterType      uint8
+	ParameterValue     uint16
+	Operator           uint8 // Overlay operator - how this record combines with the previous one.
+
+	Geometry       uint8      // AIRMET_POLYGON, AIRMET_POLYLINE, AIRMET_PRISM or AIRMET_POINT.
+	AltitudeAGL    bool       // Altitudes are AGL, not MSL.
+	Points         []GeoPoint // Vertices. For a prism, the centers of its bottom and top.
+	AltitudeBottom int32      // Feet.
+	AltitudeTop    int32      // Feet.
+	RadiusLng      float64    // Prism ellipse semi-axes, nm.
+	RadiusLat      float64
+	Rotation       float64 // Prism ellipse rotation, degrees clockwise from north.
+
+	Start time.Time // Zero if not given (in effect now).
+	End   time.Time // Zero if not given (until further notice).
+}
+
+// Valid returns true if the overlay is in effect at time 't'.
+func (o *GraphicalOverlay) Valid(t time.Time) bool {
+	return (o.Start.IsZero() || !t.Before(o.Start)) && (o.End.IsZero() || t.Before(o.End))
+}
+
+// airmetTime converts a date/time field into the time nearest to 'ref' (UTC) that matches it. Fields
+// missing from the format are taken from 'ref'.
+func airmetTime(b []byte, date_time_format uint8, ref time.Time) time.Time {
+	ref = ref.UTC()
+	var t time.Time
+	switch date_time_format {
+	case 1: // Month, Day, Hours, Minutes.
+		t = time.Date(ref.Year(), time.Month(b[0]), int(b[1]), int(b[2]), int(b[3]), 0, 0, time.UTC)
+		if t.Sub(ref) > 183*24*time.Hour {
+			t = t.AddDate(-1, 0, 0)
+		} else if ref.Sub(t) > 183*24*time.Hour {
+			t = t.AddDate(1, 0, 0)
+		}
+	case 2: // Day, Hours, Minutes.
+		t = time.Date(ref.Year(), ref.Month(), int(b[0]), int(b[1]), int(b[2]), 0, 0, time.UTC)
+		if t.Sub(ref) > 15*24*time.Hour {
+			t = t.AddDate(0, -1, 0)
+		} else if ref.Sub(t) > 15*24*time.Hour {
+			t = t.AddDate(0, 1, 0)
+		}
+	case 3: // Hours, Minutes.
+		t = time.Date(ref.Year(), ref.Month(), ref.Day(), int(b[0]), int(b[1]), 0, 0, time.UTC)
+		if t.Sub(ref) > 12*time.Hour {
+			t = t.AddDate(0, 0, -1)
+		} else if ref.Sub(t) > 12*time.Hour {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	return t
+}
+
+func airmetLatLng(lat_raw, lng_raw int32, alt bool) (float64, float64) {
+	fct := float64(0.000687)
+	if alt {
+		fct = float64(0.001373)
+	}
+	lat := fct * float64(lat_raw)
+	lng := fct * float64(lng_raw)
+	if lat > 90.0 {
+		lat = lat - 180.0
+	}
+	if lng > 180.0 {
+		lng = lng - 360.0
+	}
+	return lat, lng
+}
+
+// Extended range 3D vertex: 19 bit longitude, 19 bit latitude, 10 bit altitude (100s of feet).
+func airmetVertex(b []byte) GeoPoint {
+	lng_raw := (int32(b[0]) << 11) | (int32(b[1]) << 3) | (int32(b[2]) & 0xE0 >> 5)
+	lat_raw := ((int32(b[2]) & 0x1F) << 14) | (int32(b[3]) << 6) | ((int32(b[4]) & 0xFC) >> 2)
+	alt_raw := ((int32(b[4]) & 0x03) << 8) | int32(b[5])
+	lat, lng := airmetLatLng(lat_raw, lng_raw, false)
+	return GeoPoint{Lat: lat, Lon: lng, Alt: alt_raw * 100}
+}
+
+// Decode product IDs 8-13, and the other products in the text/graphic record formats.
+func (f *UATFrame) decodeAirmet() {
+	if len(f.FISB_data) < 6 {
+		return
+	}
+	// Product header (6 bytes).
+	record_format := (uint8(f.FISB_data[0]) & 0xF0) >> 4
+	// product_version := (uint8(f.FISB_data[0]) & 0x0F)
+	record_count := (uint8(f.FISB_data[1]) & 0xF0) >> 4
+	location_identifier := strings.Replace(dlac_decode(f.FISB_data[2:], 3), "\x03", "", -1)
+	// record_reference := (uint8(f.FISB_data[5])) //FIXME: Special values. 0x00 means "use location_identifier". 0xFF means "use different reference". (4-3).
+	// Not sure when this is even used.
+	// rwy_designator := (record_reference & FC) >> 4
+	// parallel_rwy_designator := record_reference & 0x03 // 0 = NA, 1 = R, 2 = L, 3 = C (Figure 4-2).
+
+	f.RecordFormat = record_format
+	f.LocationIdentifier = location_identifier
+
+	/*
+		0 - No data
+		1 - Unformatted ASCII Text
+		2 - Unformatted DLAC Text
+		3 - Unformatted DLAC Text w/ dictionary
+		4 - Formatted Text using ASN.1/PER
+		5-7 - Future Use
+		8 - Graphical Overlay
+		9-15 - Future Use
+	*/
+	now := time.Now()
+	record_data := f.FISB_data[6:]
+	for i := 0; i < int(record_count); i++ {
+		var record_length int
+		switch record_format {
+		case RECORD_FORMAT_ASCII, RECORD_FORMAT_TEXT:
+			record_length = f.decodeAirmetText(record_data, record_format == RECORD_FORMAT_ASCII)
+		case RECORD_FORMAT_OVERLAY:
+			var o *GraphicalOverlay
+			o, record_length = decodeGraphicalOverlay(record_data, now)
+			if o != nil {
+				o.ProductID = f.Product_id
+				o.LocationIdentifier = location_identifier
+				f.Overlays = append(f.Overlays, *o)
+				f.Points = append(f.Points, o.Points...)
+				if len(f.Overlays) == 1 {
+					f.ReportNumber, f.ReportYear = o.ReportNumber, o.ReportYear
+					f.ReportStart = airmetFormatTime(o.Start)
+					f.ReportEnd = airmetFormatTime(o.End)
+				}
+			}
+		}
+		if record_length <= 0 || record_length > len(record_data) {
+			break // Unknown format or bad record.
+		}
+		record_data = record_data[record_length:]
+	}
+}
+
+func airmetFormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("01-02 15:04")
+}
+
+// Decodes a text record (6.2), adding it to Text_data. The text is DLAC encoded unless 'ascii' is set.
+// Returns the record length.
+func (f *UATFrame) decodeAirmetText(record_data []byte, ascii bool) int {
+	if len(record_data) < 5 {
+		return 0
+	}
+	record_length := (int(record_data[0]) << 8) | int(record_data[1])
+	if record_length < 5 || record_length > len(record_data) {
+		return 0
+	}
+	// Report identifier = report number + report year.
+	report_number := (uint16(record_data[2]) << 6) | ((uint16(record_data[3]) & 0xFC) >> 2)
+	report_year := ((uint16(record_data[3]) & 0x03) << 5) | ((uint16(record_data[4]) & 0xF8) >> 3)
+	// report_status := (uint8(record_data[4]) & 0x04) >> 2 //TODO: 0 = cancelled, 1 = active.
+	if len(f.Text_data) == 0 {
+		f.ReportNumber, f.ReportYear = report_number, report_year
+	}
+	var text_data string
+	if ascii {
+		text_data = string(record_data[5:record_length])
+	} else {
+		text_data = dlac_decode(record_data[5:], uint32(record_length-5))
+	}
+	for _, t := range formatDLACData(text_data) {
+		if len(t) > 0 {
+			f.Text_data = append(f.Text_data, t)
+		}
+	}
+	return record_length
+}
+
+// Decodes a graphical overlay record (6.22). Returns nil if the record is truncated or its geometry
+// isn't supported, and the record length.
+func decodeGraphicalOverlay(record_data []byte, now time.Time) (*GraphicalOverlay, int) {
+	if len(record_data) < 7 {
+		return nil, 0
+	}
+	record_length := (int(record_data[0]) << 2) | ((int(record_data[1]) & 0xC0) >> 6)
+	if record_length > len(record_data) {
+		return nil, 0
+	}
+	record_data = record_data[:record_length]
+
+	o := new(GraphicalOverlay)
+	// Report identifier = report number + report year.
+	o.ReportNumber = ((uint16(record_data[1]) & 0x3F) << 8) | uint16(record_data[2])
+	o.ReportYear = (uint16(record_data[3]) & 0xFE) >> 1
+	o.RecordID = ((uint8(record_data[4]) & 0x1E) >> 1) + 1 // Document instructs to add 1.
+	object_label_flag := uint8(record_data[4] & 0x01)
+
+	if object_label_flag == 0 { // Numeric index.
+		o.ObjectLabel = fmt.Sprintf("%d", (uint16(record_data[5])<<8)|uint16(record_data[6]))
+		record_data = record_data[7:]
+	} else {
+		if len(record_data) < 14 {
+			return nil, record_length
+		}
+		o.ObjectLabel = strings.TrimSpace(strings.Replace(dlac_decode(record_data[5:], 9), "\x03", "", -1))
+		record_data = record_data[14:]
+	}
+
+	if len(record_data) < 2 {
+		return nil, record_length
+	}
+	// element_flag := (uint8(record_data[0]) & 0x80) >> 7
+	qualifier_flag := (uint8(record_data[0]) & 0x40) >> 6
+	param_flag := (uint8(record_data[0]) & 0x20) >> 5
+	o.ObjectElement = uint8(record_data[0]) & 0x1F
+	o.ObjectType = (uint8(record_data[1]) & 0xF0) >> 4
+	o.ObjectStatus = uint8(record_data[1]) & 0x0F
+	record_data = record_data[2:]
+
+	if qualifier_flag != 0 {
+		if len(record_data) < 3 {
+			return nil, record_length
+		}
+		o.ObjectQualifier = (uint32(record_data[0]) << 16) | (uint32(record_data[1]) << 8) | uint32(record_data[2])
+		record_data = record_data[3:]
+	}
+	if param_flag != 0 {
+		if len(record_data) < 2 {
+			return nil, record_length
+		}
+		o.ParameterType = (uint8(record_data[0]) & 0xF8) >> 3
+		o.ParameterValue = ((uint16(record_data[0]) & 0x07) << 8) | uint16(record_data[1])
+		record_data = record_data[2:]
+	}
+
+	if len(record_data) < 2 {
+		return nil, record_length
+	}
+	record_applicability_options := (uint8(record_data[0]) & 0xC0) >> 6
+	date_time_format := (uint8(record_data[0]) & 0x30) >> 4
+	geometry_overlay_options := uint8(record_data[0]) & 0x0F
+	o.Operator = (uint8(record_data[1]) & 0xC0) >> 6
+	overlay_vertices_count := int(uint8(record_data[1])&0x3F) + 1 // Document instructs to add 1. (6.20).
+	record_data = record_data[2:]
+
+	// Start and/or end times, 4 bytes each.
+	num_times := []int{0, 1, 1, 2}[record_applicability_options]
+	if len(record_data) < 4*num_times {
+		return nil, record_length
+	}
+	switch record_applicability_options {
+	case 0: // No times given. UFN.
+	case 1: // Start time only. WEF.
+		o.Start = airmetTime(record_data, date_time_format, now)
+	case 2: // End time only. TIL.
+		o.End = airmetTime(record_data, date_time_format, now)
+	case 3: // Both start and end times. WEF.
+		o.Start = airmetTime(record_data, date_time_format, now)
+		o.End = airmetTime(record_data[4:], date_time_format, now)
+	}
+	record_data = record_data[4*num_times:]
+
+	// Now we have the vertices.
+	switch geometry_overlay_options {
+	case 3, 4, 5, 6, 9, 10:
+		// 3 = Extended Range 3D Polygon (MSL), 4 = (AGL).
+		// 5 = Extended Range 3D Polyline (MSL), 6 = (AGL).
+		// 9 = Extended Range 3D Point (AGL), 10 = (MSL). p.47.
+		switch geometry_overlay_options {
+		case 3, 4:
+			o.Geometry = AIRMET_POLYGON
+		case 5, 6:
+			o.Geometry = AIRMET_POLYLINE
+		default:
+			o.Geometry = AIRMET_POINT
+			overlay_vertices_count = 1
+		}
+		o.AltitudeAGL = geometry_overlay_options == 4 || geometry_overlay_options == 6 || geometry_overlay_options == 9
+		if len(record_data) < 6*overlay_vertices_count {
+			return nil, record_length
+		}
+		for i := 0; i < overlay_vertices_count; i++ {
+			p := airmetVertex(record_data[6*i:])
+			if i == 0 || p.Alt < o.AltitudeBottom {
+				o.AltitudeBottom = p.Alt
+			}
+			if i == 0 || p.Alt > o.AltitudeTop {
+				o.AltitudeTop = p.Alt
+			}
+			o.Points = append(o.Points, p)
+		}
+	case 7, 8: // Extended Range Circular Prism (7 = MSL, 8 = AGL)
+		if len(record_data) < 14 {
+			return nil, record_length
+		}
+		lng_bot_raw := (int32(record_data[0]) << 10) | (int32(record_data[1]) << 2) | (int32(record_data[2]) & 0xC0 >> 6)
+		lat_bot_raw := ((int32(record_data[2]) & 0x3F) << 12) | (int32(record_data[3]) << 4) | ((int32(record_data[4]) & 0xF0) >> 4)
+		lng_top_raw := ((int32(record_data[4]) & 0x0F) << 14) | (int32(record_data[5]) << 6) | ((int32(record_data[6]) & 0xFC) >> 2)
+		lat_top_raw := ((int32(record_data[6]) & 0x03) << 16) | (int32(record_data[7]) << 8) | int32(record_data[8])
+
+		alt_bot_raw := (int32(record_data[9]) & 0xFE) >> 1
+		alt_top_raw := ((int32(record_data[9]) & 0x01) << 6) | ((int32(record_data[10]) & 0xFC) >> 2)
+
+		r_lng_raw := ((int32(record_data[10]) & 0x03) << 7) | ((int32(record_data[11]) & 0xFE) >> 1)
+		r_lat_raw := ((int32(record_data[11]) & 0x01) << 8) | int32(record_data[12])
+		alpha := int32(record_data[13])
+
+		lat_bot, lng_bot := airmetLatLng(lat_bot_raw, lng_bot_raw, true)
+		lat_top, lng_top := airmetLatLng(lat_top_raw, lng_top_raw, true)
+
+		o.Geometry = AIRMET_PRISM
+		o.AltitudeAGL = geometry_overlay_options == 8
+		o.AltitudeBottom = alt_bot_raw * 500 // 500 ft increments.
+		o.AltitudeTop = alt_top_raw * 500
+		o.Points = []GeoPoint{
+			{Lat: lat_bot, Lon: lng_bot, Alt: o.AltitudeBottom},
+			{Lat: lat_top, Lon: lng_top, Alt: o.AltitudeTop},
+		}
+		o.RadiusLng = float64(r_lng_raw) * float64(0.2)
+		o.RadiusLat = float64(r_lat_raw) * float64(0.2)
+		o.Rotation = float64(alpha)
+	default: // Unknown geometry.
+		return nil, record_length
+	}
+
+	return o, record_length
+}
+
+// GeoJSON output.
+
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+func geoJSONPosition(p GeoPoint) []float64 {
+	return []float64{p.Lon, p.Lat}
+}
+
+// prismOutline approximates the ellipse of a prism as a closed ring of 'airmetPrismSteps' vertices.
+func (o *GraphicalOverlay) prismOutline() [][]float64 {
+	center := o.Points[0]
+	a := o.Rotation * math.Pi / 180
+	ring := make([][]float64, 0, airmetPrismSteps+1)
+	for i := 0; i <= airmetPrismSteps; i++ {
+		theta := 2 * math.Pi * float64(i%airmetPrismSteps) / airmetPrismSteps
+		x := o.RadiusLng * math.Cos(theta) // East, nm.
+		y := o.RadiusLat * math.Sin(theta) // North, nm.
+		east := x*math.Cos(a) + y*math.Sin(a)
+		north := -x*math.Sin(a) + y*math.Cos(a)
+		lat := center.Lat + north/60
+		lng := center.Lon + east/(60*math.Cos(center.Lat*math.Pi/180))
+		ring = append(ring, []float64{lng, lat})
+	}
+	return ring
+}
+
+// GeoJSON returns the overlay as a GeoJSON feature. Prisms are approximated by a polygon.
+func (o *GraphicalOverlay) GeoJSON() GeoJSONFeature {
+	var g GeoJSONGeometry
+	switch o.Geometry {
+	case AIRMET_POLYGON:
+		ring := make([][]float64, 0, len(o.Points)+1)
+		for _, p := range o.Points {
+			ring = append(ring, geoJSONPosition(p))
+		}
+		if len(ring) > 0 && (ring[0][0] != ring[len(ring)-1][0] || ring[0][1] != ring[len(ring)-1][1]) {
+			ring = append(ring, ring[0]) // Close the ring.
+		}
+		g = GeoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{ring}}
+	case AIRMET_POLYLINE:
+		line := make([][]float64, 0, len(o.Points))
+		for _, p := range o.Points {
+			line = append(line, geoJSONPosition(p))
+		}
+		g = GeoJSONGeometry{Type: "LineString", Coordinates: line}
+	case AIRMET_PRISM:
+		g = GeoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{o.prismOutline()}}
+	default:
+		g = GeoJSONGeometry{Type: "Point", Coordinates: geoJSONPosition(o.Points[0])}
+	}
+
+	altitudeReference := "MSL"
+	if o.AltitudeAGL {
+		altitudeReference = "AGL"
+	}
+	props := map[string]interface{}{
+		"ProductID":          o.ProductID,
+		"LocationIdentifier": o.LocationIdentifier,
+		"ReportNumber":       o.ReportNumber,
+		"ReportYear":         o.ReportYear,
+		"RecordID":           o.RecordID,
+		"ObjectLabel":        o.ObjectLabel,
+		"ObjectType":         o.ObjectType,
+		"ObjectStatus":       o.ObjectStatus,
+		"AltitudeBottom":     o.AltitudeBottom,
+		"AltitudeTop":        o.AltitudeTop,
+		"AltitudeReference":  altitudeReference,
+	}
+	if !o.Start.IsZero() {
+		props["Start"] = o.Start
+	}
+	if !o.End.IsZero() {
+		props["End"] = o.End
+	}
+	return GeoJSONFeature{Type: "Feature", Geometry: g, Properties: props}
+}
@@ -61,19 +61,32 @@ func block_location(block_num int, ns_flag bool, scale_factor int) (float64, flo
 }
 
 func (f *UATFrame) decodeNexradFrame() {
-	if len(f.FISB_data) < 4 { // Short read.
-		return
+	// Empty CONUS blocks are filled with level 1.
+	empty := uint16(0)
+	if f.Product_id == 64 {
+		empty = 1
+	}
+	f.NEXRAD = decodeGlobalBlocks(f.FISB_data, f.Product_id, empty, 3)
+}
+
+// Decodes a product in the global block representation - NEXRAD (63, 64) and the other gridded products
+// (echo tops, lightning). Returns a single RLE encoded block, or the blocks marked in an empty block bitmap
+// with all bins set to 'empty'. Each RLE byte holds a bin value in the low 'value_bits' bits and the run
+// length minus one in the rest.
+func decodeGlobalBlocks(data []byte, product_id uint32, empty uint16, value_bits uint) []NEXRADBlock {
+	if len(data) < 4 { // Short read.
+		return nil
 	}
 
-	rle_flag := (uint32(f.FISB_data[0]) & 0x80) != 0
-	ns_flag := (uint32(f.FISB_data[0]) & 0x40) != 0
-	block_num := ((int(f.FISB_data[0]) & 0x0f) << 16) | (int(f.FISB_data[1]) << 8) | (int(f.FISB_data[2]))
-	scale_factor := (int(f.FISB_data[0]) & 0x30) >> 4
+	rle_flag := (uint32(data[0]) & 0x80) != 0
+	ns_flag := (uint32(data[0]) & 0x40) != 0
+	block_num := ((int(data[0]) & 0x0f) << 16) | (int(data[1]) << 8) | (int(data[2]))
+	scale_factor := (int(data[0]) & 0x30) >> 4
 
 	if rle_flag { // Single bin, RLE encoded.
 		lat, lon, h, w := block_location(block_num, ns_flag, scale_factor)
 		var tmp NEXRADBlock
-		tmp.Radar_Type = f.Product_id
+		tmp.Radar_Type = product_id
 		tmp.Scale = scale_factor
 		tmp.LatNorth = lat
 		tmp.LonWest = lon
@@ -81,67 +94,64 @@ func (f *UATFrame) decodeNexradFrame() {
 		tmp.Width = w
 		tmp.Intensity = make([]uint16, 0)
 
-		intensityData := f.FISB_data[3:]
+		intensityData := data[3:]
 		for _, v := range intensityData {
-			intensity := uint16(v) & 0x7
-			runlength := (uint16(v) >> 3) + 1
+			intensity := uint16(v) & (1<<value_bits - 1)
+			runlength := (uint16(v) >> value_bits) + 1
 			for runlength > 0 {
 				tmp.Intensity = append(tmp.Intensity, intensity)
 				runlength--
 			}
 		}
-		f.NEXRAD = []NEXRADBlock{tmp}
+		return []NEXRADBlock{tmp}
+	}
+
+	var row_start int
+	var row_size int
+	if block_num >= 405000 {
+		row_start = block_num - ((block_num - 405000) % 225)
+		row_size = 225
 	} else {
-		var row_start int
-		var row_size int
-		if block_num >= 405000 {
-			row_start = block_num - ((block_num - 405000) % 225)
-			row_size = 225
-		} else {
-			row_start = block_num - (block_num % 450)
-			row_size = 450
-		}
+		row_start = block_num - (block_num % 450)
+		row_size = 450
+	}
 
-		row_offset := block_num - row_start
+	row_offset := block_num - row_start
 
-		L := int(f.FISB_data[3] & 15)
+	L := int(data[3] & 15)
 
-		if len(f.FISB_data) < L+3 { // Short read.
-			return
-		}
+	if len(data) < L+3 { // Short read.
+		return nil
+	}
 
-		for i := 0; i < L; i++ {
-			var bb int
-			if i == 0 {
-				bb = (int(f.FISB_data[3]) & 0xF0) | 0x08
-			} else {
-				bb = int(f.FISB_data[i+3])
-			}
+	var ret []NEXRADBlock
+	for i := 0; i < L; i++ {
+		var bb int
+		if i == 0 {
+			bb = (int(data[3]) & 0xF0) | 0x08
+		} else {
+			bb = int(data[i+3])
+		}
 
-			for j := 0; j < 8; j++ {
-				if bb&(1<<uint(j)) != 0 {
-					row_x := (row_offset + 8*i + j - 3) % row_size
-					bn := row_start + row_x
-					lat, lon, h, w := block_location(bn, ns_flag, scale_factor)
-					var tmp NEXRADBlock
-					tmp.Radar_Type = f.Product_id
-					tmp.Scale = scale_factor
-					tmp.LatNorth = lat
-					tmp.LonWest = lon
-					tmp.Height = h
-					tmp.Width = w
-					tmp.Intensity = make([]uint16, 0)
-					for k := 0; k < 128; k++ {
-						z := uint16(0)
-						if f.Product_id == 64 {
-							z = 1
-						}
-						tmp.Intensity = append(tmp.Intensity, z)
-					}
-					f.NEXRAD = append(f.NEXRAD, tmp)
+		for j := 0; j < 8; j++ {
+			if bb&(1<<uint(j)) != 0 {
+				row_x := (row_offset + 8*i + j - 3) % row_size
+				bn := row_start + row_x
+				lat, lon, h, w := block_location(bn, ns_flag, scale_factor)
+				var tmp NEXRADBlock
+				tmp.Radar_Type = product_id
+				tmp.Scale = scale_factor
+				tmp.LatNorth = lat
+				tmp.LonWest = lon
+				tmp.Height = h
+				tmp.Width = w
+				tmp.Intensity = make([]uint16, 0)
+				for k := 0; k < 128; k++ {
+					tmp.Intensity = append(tmp.Intensity, empty)
 				}
+				ret = append(ret, tmp)
 			}
 		}
 	}
-
+	return ret
 }
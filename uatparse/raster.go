@@ -0,0 +1,56 @@
+package uatparse
+
+// Echo tops (81, 82), lightning (101, 102) and generic raster (401) products. These are gridded like
+// NEXRAD 63/64 and use the same global block representation, but the bins hold the product's own
+// levels - echo top altitude bands, or lightning strike density - rather than reflectivity.
+// Storm tops and velocity (83) isn't a block grid - it is decoded as graphical overlay records, see
+// decodeAirmet().
+
+const (
+	BLOCK_BINS_WIDE = 32 // Bins per block, west to east.
+	BLOCK_BINS_HIGH = 4  // Bins per block, north to south.
+)
+
+// Bits per bin value in the run length encoding of each product. The rest of each byte is the run length.
+var rasterValueBits = map[uint32]uint{
+	81:  4, // 16 levels.
+	82:  3, // 8 levels.
+	101: 3,
+	102: 3,
+	401: 3,
+}
+
+type RasterBlock struct {
+	Product_id uint32
+	Scale      int
+	LatNorth   float64
+	LonWest    float64
+	Height     float64
+	Width      float64
+	Values     []uint16 // BLOCK_BINS_WIDE x BLOCK_BINS_HIGH levels, row by row from the north-west corner.
+}
+
+// BinLocation returns the north-west corner of bin 'i'.
+func (b *RasterBlock) BinLocation(i int) (float64, float64) {
+	lat := b.LatNorth - float64(i/BLOCK_BINS_WIDE)*b.Height/BLOCK_BINS_HIGH
+	lon := b.LonWest + float64(i%BLOCK_BINS_WIDE)*b.Width/BLOCK_BINS_WIDE
+	return lat, lon
+}
+
+func (f *UATFrame) decodeRasterFrame() {
+	value_bits, ok := rasterValueBits[f.Product_id]
+	if !ok {
+		return
+	}
+	for _, b := range decodeGlobalBlocks(f.FISB_data, f.Product_id, 0, value_bits) {
+		f.Raster = append(f.Raster, RasterBlock{
+			Product_id: b.Radar_Type,
+			Scale:      b.Scale,
+			LatNorth:   b.LatNorth,
+			LonWest:    b.LonWest,
+			Height:     b.Height,
+			Width:      b.Width,
+			Values:     b.Intensity,
+		})
+	}
+}
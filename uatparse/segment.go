@@ -0,0 +1,137 @@
+package uatparse
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Long FIS-B products (NOTAMs, TAFs, graphical AIRMETs/SIGMETs) may be split across several APDUs,
+// usually in different uplinks. Each segment carries the product file ID, the number of segments
+// in the product, and its own segment number. DecodeUplink() leaves segments undecoded - they are
+// collected here until the product is complete.
+
+const (
+	DEFAULT_SEGMENT_TIMEOUT = 2 * time.Minute
+
+	// Each segment of a text/graphic product (NOTAM, AIRMET, SIGMET, ...) starts with a copy of the
+	// product header - record format, product version, record count, location identifier and record
+	// reference. Only the first copy is kept.
+	SEGMENT_PRODUCT_HEADER_LEN = 6
+)
+
+// Segments are grouped by ground station, product, and product file ID.
+type segmentKey struct {
+	lat, lon      float64
+	productID     uint32
+	productFileID uint32
+}
+
+type segmentSet struct {
+	segments []*UATFrame // By APDU number - 1. Nil until received.
+	received int
+	lastSeen time.Time
+}
+
+type SegmentReassembler struct {
+	mu      *sync.Mutex
+	timeout time.Duration
+	sets    map[segmentKey]*segmentSet
+
+	numCompleted uint64 // Products reassembled.
+	numExpired   uint64 // Incomplete products discarded after 'timeout'.
+}
+
+// NewSegmentReassembler returns a reassembler that discards incomplete products when no segment has
+// been received for 'timeout'.
+func NewSegmentReassembler(timeout time.Duration) *SegmentReassembler {
+	return &SegmentReassembler{
+		mu:      &sync.Mutex{},
+		timeout: timeout,
+		sets:    make(map[segmentKey]*segmentSet),
+	}
+}
+
+// Reassemble collects the segments in a decoded uplink. Products that are now complete are decoded,
+// appended to u.Frames, and returned.
+func (r *SegmentReassembler) Reassemble(u *UATMsg) []*UATFrame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, set := range r.sets {
+		if now.Sub(set.lastSeen) >= r.timeout {
+			delete(r.sets, k)
+			r.numExpired++
+		}
+	}
+
+	var ret []*UATFrame
+	for _, f := range u.Frames {
+		if !f.s_f || f.productFileLength == 0 || f.apduNumber == 0 || f.apduNumber > f.productFileLength {
+			continue
+		}
+		k := segmentKey{lat: u.Lat, lon: u.Lon, productID: f.Product_id, productFileID: f.productFileID}
+		set, ok := r.sets[k]
+		if !ok || len(set.segments) != int(f.productFileLength) {
+			// New product, or a product file ID that has been reused with a different length.
+			set = &segmentSet{segments: make([]*UATFrame, f.productFileLength)}
+			r.sets[k] = set
+		}
+		set.lastSeen = now
+		if set.segments[f.apduNumber-1] == nil {
+			set.received++
+		}
+		set.segments[f.apduNumber-1] = f // A retransmission replaces the earlier copy.
+		if set.received < len(set.segments) {
+			continue
+		}
+		delete(r.sets, k)
+		r.numCompleted++
+		ret = append(ret, set.assemble())
+	}
+
+	u.Frames = append(u.Frames, ret...)
+	return ret
+}
+
+// Counts returns the number of products reassembled, and the number of incomplete products discarded.
+func (r *SegmentReassembler) Counts() (completed, expired uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.numCompleted, r.numExpired
+}
+
+// assemble joins the segments' data into one frame and decodes the product. The time is taken from
+// the first segment.
+func (set *segmentSet) assemble() *UATFrame {
+	first := set.segments[0]
+	f := &UATFrame{
+		Frame_type:   first.Frame_type,
+		Product_id:   first.Product_id,
+		FISB_month:   first.FISB_month,
+		FISB_day:     first.FISB_day,
+		FISB_hours:   first.FISB_hours,
+		FISB_minutes: first.FISB_minutes,
+		FISB_seconds: first.FISB_seconds,
+		a_f:          first.a_f,
+		g_f:          first.g_f,
+		p_f:          first.p_f,
+	}
+	var header []byte
+	if len(first.FISB_data) >= SEGMENT_PRODUCT_HEADER_LEN {
+		header = first.FISB_data[:SEGMENT_PRODUCT_HEADER_LEN]
+	}
+	for i, s := range set.segments {
+		data := s.FISB_data
+		if i > 0 && len(header) > 0 && bytes.HasPrefix(data, header) {
+			data = data[len(header):]
+		}
+		f.FISB_data = append(f.FISB_data, data...)
+	}
+	f.FISB_length = uint32(len(f.FISB_data))
+	f.Raw_data = f.FISB_data
+	f.frame_length = f.FISB_length
+	f.decodeProduct()
+	return f
+}
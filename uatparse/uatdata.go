@@ -8,10 +8,12 @@ const (
 	UATMSG_AIRMET = 3 // AIRMET. Decoded.
 
 	// How the coordinates should be used in a graphical AIRMET.
-	AIRMET_POLYGON = 1
-	AIRMET_ELLIPSE = 2
-	AIRMET_PRISM   = 3
-	AIRMET_3D      = 4
+	AIRMET_POLYGON  = 1
+	AIRMET_ELLIPSE  = 2
+	AIRMET_PRISM    = 3
+	AIRMET_3D       = 4
+	AIRMET_POLYLINE = 5
+	AIRMET_POINT    = 6
 )
 
 // Points can be in 3D - take care that altitude is used correctly.
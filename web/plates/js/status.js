@@ -109,6 +109,9 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.UAT_SIGMET_total = status.UAT_SIGMET_total;
 			$scope.UAT_PIREP_total = status.UAT_PIREP_total;
 			$scope.UAT_NOTAM_total = status.UAT_NOTAM_total;
+			$scope.UAT_TOPS_total = status.UAT_TOPS_total;
+			$scope.UAT_LIGHTNING_total = status.UAT_LIGHTNING_total;
+			$scope.UAT_GENERIC_total = status.UAT_GENERIC_total;
 			$scope.UAT_OTHER_total = status.UAT_OTHER_total;
 			// Errors array.
 			if (status.Errors.length > 0) {
@@ -80,9 +80,10 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval) {
 		new_traffic.time = utcTimeString(timestamp);
 		new_traffic.age = obj.Age;
 		new_traffic.ageLastAlt = obj.AgeLastAlt;
-		new_traffic.src = obj.Last_source; // 1=ES, 2=UAT
+		new_traffic.src = obj.Last_source; // 1=ES, 2=UAT, 3=GDL90 input
 		new_traffic.bearing = Math.round(obj.Bearing); // degrees true 
 		new_traffic.dist = (obj.Distance/1852); // nautical miles
+		new_traffic.ghost = obj.OwnshipGhost; // TIS-B/ADS-R rebroadcast of ownship, not sent to the EFB
 		// return new_aircraft;
 	}
 